@@ -2,25 +2,38 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/daemon"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
 	"github.com/MatteoGioioso/seeonethirtyseven/dcs_proxy"
 	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type Config struct {
 	Port       string
 	InstanceID string
+	// LocalConfig is the node override of the cluster config, it is only shown
+	LocalConfig dcs.ClusterConfig
+	Tags        dcs.Tags
 }
 
 type Api struct {
 	Postmaster postgresql.Postmaster
 	DcsProxy   dcs_proxy.ProxyImpl
+	State      *daemon.StateMachine
+	Restarts   *daemon.RestartScheduler
 	Log        *logrus.Entry
 	QuitChan   chan int
 	Config
+
+	// rollingRestartMu is held while a rolling restart is running, only one can run at a time
+	rollingRestartMu sync.Mutex
 }
 
 func (s *Api) Start(ctx context.Context) {
@@ -31,8 +44,8 @@ func (s *Api) Start(ctx context.Context) {
 
 	r.GET("/switchover/:instance-id", func(c *gin.Context) {
 		instanceID := c.Param("instance-id")
-		if err := s.DcsProxy.Promote(ctx, instanceID); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err := s.switchover(ctx, instanceID); err != nil {
+			c.JSON(failoverErrorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
 
@@ -41,12 +54,341 @@ func (s *Api) Start(ctx context.Context) {
 		})
 	})
 
+	// POST runs the switchover right away, or schedules it when scheduled_at is given
+	r.POST("/switchover", func(c *gin.Context) {
+		var request SwitchoverRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if request.Candidate == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "candidate is required"})
+			return
+		}
+
+		if request.ScheduledAt != nil {
+			failover, err := s.scheduleSwitchover(ctx, request.Candidate, *request.ScheduledAt)
+			if err != nil {
+				c.JSON(failoverErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusAccepted, gin.H{
+				"message":    "switchover scheduled",
+				"switchover": failover,
+			})
+			return
+		}
+
+		if err := s.switchover(ctx, request.Candidate); err != nil {
+			c.JSON(failoverErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": fmt.Sprintf("instance %v promoted", request.Candidate),
+		})
+	})
+
+	r.DELETE("/switchover", func(c *gin.Context) {
+		if err := s.cancelScheduledSwitchover(ctx); err != nil {
+			c.JSON(failoverErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "scheduled switchover cancelled",
+		})
+	})
+
+	r.POST("/failover", func(c *gin.Context) {
+		var request FailoverRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if request.Candidate == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "candidate is required"})
+			return
+		}
+
+		if err := s.failover(ctx, request.Candidate); err != nil {
+			c.JSON(failoverErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": fmt.Sprintf("instance %v promoted", request.Candidate),
+		})
+	})
+
+	r.GET("/status", func(c *gin.Context) {
+		syncState, err := s.DcsProxy.GetSyncState(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		pause, err := s.DcsProxy.GetPause(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		pendingRestart := make([]string, 0)
+		if s.Postmaster.IsRunning() {
+			if pendingRestart, err = s.Postmaster.GetPendingRestart(ctx); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		applyDelay, err := s.getApplyDelay(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"paused":                     pause != nil,
+			"instance_id":                s.InstanceID,
+			"tags":                       s.Tags,
+			"apply_delay":                applyDelay,
+			"state":                      s.State.Status(),
+			"pending_restart":            len(pendingRestart) > 0,
+			"pending_restart_parameters": pendingRestart,
+			"restart":                    s.Restarts.Status(),
+			"synchronous_replication": gin.H{
+				"leader":         syncState.Leader,
+				"standbys":       syncState.Members,
+				"quorum":         syncState.Quorum,
+				"strict":         syncState.Strict,
+				"writes_blocked": syncState.WritesBlocked(),
+			},
+		})
+	})
+
+	// GET /replica is meant as a load balancer health check for read only traffic
+	r.GET("/replica", func(c *gin.Context) {
+		if s.Tags.NoLoadBalance() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("member is tagged %v", dcs.TagNoLoadBalance)})
+			return
+		}
+
+		if state := s.State.Current(); state != daemon.StateRunningReplica {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("member is %v", state)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "member is running as replica",
+		})
+	})
+
+	r.GET("/cluster", func(c *gin.Context) {
+		instances, err := s.DcsProxy.GetClusterInstances(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		syncState, err := s.DcsProxy.GetSyncState(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		failover, err := s.DcsProxy.GetFailover(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		pause, err := s.DcsProxy.GetPause(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"paused":   pause != nil,
+			"pause":    pause,
+			"members":  instances,
+			"sync":     syncState,
+			"failover": failover,
+		})
+	})
+
+	r.GET("/config", func(c *gin.Context) {
+		clusterConfig, err := s.DcsProxy.GetClusterConfig(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"cluster": clusterConfig,
+			"local":   s.LocalConfig,
+		})
+	})
+
+	// PUT replaces the whole cluster config, PATCH merges the given fields into it
+	r.PUT("/config", func(c *gin.Context) {
+		var clusterConfig dcs.ClusterConfig
+		if err := c.ShouldBindJSON(&clusterConfig); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.saveClusterConfig(ctx, c, clusterConfig)
+	})
+
+	r.PATCH("/config", func(c *gin.Context) {
+		var patch dcs.ClusterConfig
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		clusterConfig, err := s.DcsProxy.GetClusterConfig(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.saveClusterConfig(ctx, c, clusterConfig.Merge(patch))
+	})
+
+	// While the cluster is paused every daemon only observes and publishes its status
+	r.PUT("/pause", func(c *gin.Context) {
+		var pause dcs.Pause
+		if err := c.ShouldBindJSON(&pause); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		pause.Since = time.Now().UTC()
+		if err := s.DcsProxy.SavePause(ctx, pause); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "cluster paused",
+			"pause":   pause,
+		})
+	})
+
+	r.DELETE("/pause", func(c *gin.Context) {
+		pause, err := s.DcsProxy.GetPause(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if pause == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "the cluster is not paused"})
+			return
+		}
+
+		if err := s.DcsProxy.DeletePause(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "cluster resumed",
+		})
+	})
+
+	r.POST("/restart", func(c *gin.Context) {
+		var request daemon.RestartRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// A paused cluster skips its cycles: the restart would run at an arbitrary time after the pause is lifted
+		if pause, err := s.DcsProxy.GetPause(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else if pause != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": ErrClusterPaused.Error()})
+			return
+		}
+
+		if err := s.Restarts.Schedule(request); errors.Is(err, daemon.ErrRestartAlreadyScheduled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "restart scheduled",
+			"restart": s.Restarts.Status(),
+		})
+	})
+
+	r.DELETE("/restart", func(c *gin.Context) {
+		if !s.Restarts.Cancel() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no restart is scheduled"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "scheduled restart cancelled",
+		})
+	})
+
+	r.POST("/restart/rolling", func(c *gin.Context) {
+		var request RollingRestartRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if pause, err := s.DcsProxy.GetPause(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else if pause != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": ErrClusterPaused.Error()})
+			return
+		}
+
+		if !s.rollingRestartMu.TryLock() {
+			c.JSON(http.StatusConflict, gin.H{"error": "a rolling restart is already running"})
+			return
+		}
+
+		go func() {
+			defer s.rollingRestartMu.Unlock()
+			if err := s.rollingRestart(ctx, request); err != nil {
+				s.Log.Errorf("rolling restart failed: %v", err)
+				return
+			}
+
+			s.Log.Infof("rolling restart completed")
+		}()
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "rolling restart started",
+		})
+	})
+
 	r.GET("/stop", func(c *gin.Context) {
 		if err := s.Postmaster.Stop(postgresql.StopModeSmart); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
+		if err := s.State.Transition(daemon.StateStopped, "postgres stopped from the api"); err != nil {
+			s.Log.Errorf("%v", err)
+		}
+
 		c.JSON(http.StatusOK, gin.H{
 			"message": fmt.Sprintf("postgres process has been stopped"),
 		})
@@ -67,6 +409,20 @@ func (s *Api) Start(ctx context.Context) {
 	}
 }
 
+func (s *Api) saveClusterConfig(ctx context.Context, c *gin.Context, clusterConfig dcs.ClusterConfig) {
+	if err := clusterConfig.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.DcsProxy.SaveClusterConfig(ctx, clusterConfig); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, clusterConfig)
+}
+
 // If the DCS is not reachable, then we should not allow any manual operation to avoid inconsistency in the cluster state
 func (s *Api) shouldAPIBeBlocked(ctx context.Context) (bool, error) {
 	if _, err := s.DcsProxy.GetRole(ctx); err != nil {
@@ -75,3 +431,23 @@ func (s *Api) shouldAPIBeBlocked(ctx context.Context) (bool, error) {
 
 	return false, nil
 }
+
+// getApplyDelay reports the delay the member is configured with against how far behind the leader its replay actually
+// is, the latter only for a running replica
+func (s *Api) getApplyDelay(ctx context.Context) (gin.H, error) {
+	applyDelay := gin.H{
+		"intended_seconds": s.Tags.RecoveryMinApplyDelay().Seconds(),
+		"replay_seconds":   nil,
+	}
+	if s.State.Current() != daemon.StateRunningReplica {
+		return applyDelay, nil
+	}
+
+	replayDelay, err := s.Postmaster.GetReplayDelay(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	applyDelay["replay_seconds"] = replayDelay.Seconds()
+	return applyDelay, nil
+}
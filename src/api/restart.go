@@ -0,0 +1,218 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/daemon"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"net/http"
+	"time"
+)
+
+const (
+	memberRestartTimeout = 10 * time.Minute
+	memberPollInterval   = 2 * time.Second
+)
+
+type RollingRestartRequest struct {
+	PendingRestartOnly bool `json:"pending_restart_only"`
+}
+
+type memberStatus struct {
+	State   daemon.StateStatus   `json:"state"`
+	Restart daemon.RestartStatus `json:"restart"`
+}
+
+// rollingRestart restarts the replicas one at a time, then hands the leadership over to the most up-to-date replica
+// and restarts the former leader, so that the cluster is never left without a running leader
+func (s *Api) rollingRestart(ctx context.Context, request RollingRestartRequest) error {
+	instances, err := s.DcsProxy.GetClusterInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	var leader *dcs.InstanceInfo
+	replicas := make([]dcs.InstanceInfo, 0)
+	for i, instance := range instances {
+		if instance.Role == postgresql.Leader {
+			leader = &instances[i]
+		} else {
+			replicas = append(replicas, instance)
+		}
+	}
+
+	memberRequest := daemon.RestartRequest{PendingRestartOnly: request.PendingRestartOnly}
+	for _, replica := range replicas {
+		s.Log.Infof("rolling restart: restarting replica %v", replica.Hostname)
+		if err := s.restartMember(ctx, replica, memberRequest); err != nil {
+			return fmt.Errorf("could not restart replica %v: %v", replica.Hostname, err)
+		}
+	}
+
+	if leader == nil {
+		return nil
+	}
+
+	// Switching over would interrupt the writes for a restart the leader skips anyway
+	if request.PendingRestartOnly && !leader.PendingRestart {
+		s.Log.Infof("rolling restart: leader %v has no parameter pending restart", leader.Hostname)
+		return nil
+	}
+
+	candidate := pickSwitchoverCandidate(replicas)
+	if candidate == nil {
+		return fmt.Errorf("no running replica available to take over the leadership from %v", leader.Hostname)
+	}
+
+	s.Log.Infof("rolling restart: switching over from %v to %v", leader.Hostname, candidate.Hostname)
+	if err := s.switchover(ctx, candidate.ID); err != nil {
+		return fmt.Errorf("could not switchover to %v: %v", candidate.Hostname, err)
+	}
+
+	if err := s.waitForMember(ctx, candidate.ID, daemon.StateRunningLeader); err != nil {
+		return err
+	}
+
+	if err := s.waitForMember(ctx, leader.ID, daemon.StateRunningReplica); err != nil {
+		return err
+	}
+
+	s.Log.Infof("rolling restart: restarting former leader %v", leader.Hostname)
+	if err := s.restartMember(ctx, *leader, memberRequest); err != nil {
+		return fmt.Errorf("could not restart former leader %v: %v", leader.Hostname, err)
+	}
+
+	return nil
+}
+
+// pickSwitchoverCandidate returns the running replica with the highest failover priority and, among those, the least
+// lag
+func pickSwitchoverCandidate(replicas []dcs.InstanceInfo) *dcs.InstanceInfo {
+	var candidate *dcs.InstanceInfo
+	for i, replica := range replicas {
+		if replica.State != string(daemon.StateRunningReplica) || replica.Tags.NoFailover() {
+			continue
+		}
+
+		if candidate == nil {
+			candidate = &replicas[i]
+			continue
+		}
+
+		priority, candidatePriority := replica.Tags.FailoverPriority(), candidate.Tags.FailoverPriority()
+		if priority > candidatePriority || (priority == candidatePriority && replica.Lag < candidate.Lag) {
+			candidate = &replicas[i]
+		}
+	}
+
+	return candidate
+}
+
+// restartMember schedules a restart through the member api and waits until it is done
+func (s *Api) restartMember(ctx context.Context, member dcs.InstanceInfo, request daemon.RestartRequest) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, member.APIURL+"/restart", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	response, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("restart request failed with status %v", response.StatusCode)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, memberRestartTimeout)
+	defer cancel()
+
+	for {
+		status, err := s.getMemberStatus(timeout, member)
+		if err != nil {
+			s.Log.Debugf("could not get %v status: %v", member.Hostname, err)
+		} else if done, err := isRestartDone(status.Restart); done {
+			return err
+		}
+
+		select {
+		case <-time.After(memberPollInterval):
+		case <-timeout.Done():
+			return fmt.Errorf("timed out waiting for the restart of %v", member.Hostname)
+		}
+	}
+}
+
+// isRestartDone reports if the member is done with the restart request, and returns an error if the restart did not
+// happen for another reason than nothing pending restart
+func isRestartDone(status daemon.RestartStatus) (bool, error) {
+	if status.Scheduled != nil || status.InProgress || status.Last == nil {
+		return false, nil
+	}
+
+	switch status.Last.Outcome {
+	case daemon.RestartOutcomeDone, daemon.RestartOutcomeNotPending:
+		return true, nil
+	default:
+		return true, fmt.Errorf("restart %v: %v", status.Last.Outcome, status.Last.Reason)
+	}
+}
+
+func (s *Api) getMemberStatus(ctx context.Context, member dcs.InstanceInfo) (memberStatus, error) {
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, member.APIURL+"/status", nil)
+	if err != nil {
+		return memberStatus{}, err
+	}
+
+	response, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		return memberStatus{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return memberStatus{}, fmt.Errorf("status request failed with status %v", response.StatusCode)
+	}
+
+	var status memberStatus
+	if err := json.NewDecoder(response.Body).Decode(&status); err != nil {
+		return memberStatus{}, err
+	}
+
+	return status, nil
+}
+
+// waitForMember waits until the member publishes the given state in the dcs
+func (s *Api) waitForMember(ctx context.Context, instanceID string, state daemon.State) error {
+	timeout, cancel := context.WithTimeout(ctx, memberRestartTimeout)
+	defer cancel()
+
+	for {
+		instances, err := s.DcsProxy.GetClusterInstances(timeout)
+		if err != nil {
+			s.Log.Debugf("could not get cluster instances: %v", err)
+		}
+
+		for _, instance := range instances {
+			if instance.ID == instanceID && instance.State == string(state) {
+				return nil
+			}
+		}
+
+		select {
+		case <-time.After(memberPollInterval):
+		case <-timeout.Done():
+			return fmt.Errorf("timed out waiting for instance %v to be %v", instanceID, state)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MatteoGioioso/seeonethirtyseven/daemon"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs_proxy"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/sirupsen/logrus"
+)
+
+func TestIsRestartDone(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   daemon.RestartStatus
+		wantDone bool
+		wantErr  bool
+	}{
+		{name: "scheduled", status: daemon.RestartStatus{Scheduled: &daemon.RestartRequest{}}},
+		{name: "in progress", status: daemon.RestartStatus{InProgress: true}},
+		{name: "not taken yet", status: daemon.RestartStatus{}},
+		{name: "restarted", status: restartStatus(daemon.RestartOutcomeDone), wantDone: true},
+		{name: "nothing pending restart", status: restartStatus(daemon.RestartOutcomeNotPending), wantDone: true},
+		{name: "skipped", status: restartStatus(daemon.RestartOutcomeSkipped), wantDone: true, wantErr: true},
+		{name: "failed", status: restartStatus(daemon.RestartOutcomeFailed), wantDone: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done, err := isRestartDone(tt.status)
+			if done != tt.wantDone || (err != nil) != tt.wantErr {
+				t.Errorf("isRestartDone = %v, %v, want %v and an error: %v", done, err, tt.wantDone, tt.wantErr)
+			}
+		})
+	}
+}
+
+func restartStatus(outcome daemon.RestartOutcome) daemon.RestartStatus {
+	return daemon.RestartStatus{Last: &daemon.RestartResult{Outcome: outcome, Reason: "test"}}
+}
+
+// fakeMember answers the restart requests of the rolling restart with the given outcome
+type fakeMember struct {
+	mu       sync.Mutex
+	outcome  daemon.RestartOutcome
+	requests []string
+}
+
+func (m *fakeMember) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests = append(m.requests, r.Method+" "+r.URL.Path)
+	switch r.URL.Path {
+	case "/restart":
+		w.WriteHeader(http.StatusAccepted)
+	case "/status":
+		json.NewEncoder(w).Encode(memberStatus{Restart: restartStatus(m.outcome)})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (m *fakeMember) getRequests() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.requests...)
+}
+
+// newTestMember publishes the member in the dcs, its api is served by the fake member
+func newTestMember(t *testing.T, store *dcs.MemoryStore, instanceID string, info dcs.InstanceInfo, member *fakeMember) {
+	t.Helper()
+
+	server := httptest.NewServer(member)
+	t.Cleanup(server.Close)
+
+	client := dcs.NewMemory(store, dcs.Config{
+		Hostname:    instanceID,
+		InstanceID:  instanceID,
+		Lease:       10,
+		Namespace:   "seeone",
+		ClusterName: "postgresql",
+	}, logrus.NewEntry(logrus.New()))
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect() })
+
+	info.APIURL = server.URL
+	if err := client.SaveInstanceInfo(context.Background(), info); err != nil {
+		t.Fatalf("SaveInstanceInfo: %v", err)
+	}
+}
+
+func newTestApi(t *testing.T, store *dcs.MemoryStore) *Api {
+	t.Helper()
+
+	log := logrus.NewEntry(logrus.New())
+	client := dcs.NewMemory(store, dcs.Config{
+		Hostname:    "api",
+		InstanceID:  "api",
+		Lease:       10,
+		Namespace:   "seeone",
+		ClusterName: "postgresql",
+	}, log)
+	proxy := dcs_proxy.New(client, postgresql.Postmaster{}, true, log)
+	if err := proxy.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { proxy.Disconnect() })
+
+	return &Api{DcsProxy: proxy, Log: log}
+}
+
+func TestRollingRestart(t *testing.T) {
+	runningReplica := dcs.InstanceInfo{Role: postgresql.Replica, State: string(daemon.StateRunningReplica)}
+	stoppedReplica := dcs.InstanceInfo{Role: postgresql.Replica, State: string(daemon.StateStopped)}
+	pendingLeader := dcs.InstanceInfo{Role: postgresql.Leader, State: string(daemon.StateRunningLeader), PendingRestart: true}
+	leader := dcs.InstanceInfo{Role: postgresql.Leader, State: string(daemon.StateRunningLeader)}
+
+	tests := []struct {
+		name           string
+		request        RollingRestartRequest
+		leader         dcs.InstanceInfo
+		replica        dcs.InstanceInfo
+		replicaOutcome daemon.RestartOutcome
+		wantErr        string
+		leaderRequests int
+	}{
+		{
+			name:           "replica restart fails",
+			leader:         leader,
+			replica:        runningReplica,
+			replicaOutcome: daemon.RestartOutcomeFailed,
+			wantErr:        "could not restart replica b",
+		},
+		{
+			name:           "replica restart skipped",
+			leader:         leader,
+			replica:        runningReplica,
+			replicaOutcome: daemon.RestartOutcomeSkipped,
+			wantErr:        "could not restart replica b",
+		},
+		{
+			name:           "leader without parameters pending restart",
+			request:        RollingRestartRequest{PendingRestartOnly: true},
+			leader:         leader,
+			replica:        runningReplica,
+			replicaOutcome: daemon.RestartOutcomeNotPending,
+		},
+		{
+			// The leader is switched over, b being stopped there is no candidate to hand over to
+			name:           "leader with parameters pending restart",
+			request:        RollingRestartRequest{PendingRestartOnly: true},
+			leader:         pendingLeader,
+			replica:        stoppedReplica,
+			replicaOutcome: daemon.RestartOutcomeDone,
+			wantErr:        "no running replica available to take over the leadership from a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := dcs.NewMemoryStore()
+			leaderMember := &fakeMember{outcome: daemon.RestartOutcomeDone}
+			replicaMember := &fakeMember{outcome: tt.replicaOutcome}
+			newTestMember(t, store, "a", tt.leader, leaderMember)
+			newTestMember(t, store, "b", tt.replica, replicaMember)
+
+			err := newTestApi(t, store).rollingRestart(context.Background(), tt.request)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("rollingRestart: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+
+			if requests := replicaMember.getRequests(); len(requests) == 0 || requests[0] != "POST /restart" {
+				t.Errorf("the replica was not asked to restart: %v", requests)
+			}
+			if requests := leaderMember.getRequests(); len(requests) != tt.leaderRequests {
+				t.Errorf("unexpected requests to the leader: %v", requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+	"net/http"
+	"time"
+)
+
+const switchoverTimeout = 2 * time.Minute
+
+var (
+	ErrSwitchoverInProgress  = fmt.Errorf("a switchover or failover is already pending")
+	ErrInvalidCandidate      = fmt.Errorf("invalid switchover candidate")
+	ErrInvalidSchedule       = fmt.Errorf("invalid switchover schedule")
+	ErrNoScheduledSwitchover = fmt.Errorf("no switchover is scheduled")
+	ErrClusterPaused         = fmt.Errorf("the cluster is paused")
+)
+
+type FailoverRequest struct {
+	Candidate string `json:"candidate"`
+}
+
+type SwitchoverRequest struct {
+	Candidate string `json:"candidate"`
+	// ScheduledAt delays the switchover, it is run at the first cycle of the leader after it
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+}
+
+// switchover asks the running leader to hand over the leadership to the candidate
+func (s *Api) switchover(ctx context.Context, candidateID string) error {
+	leader, err := s.DcsProxy.GetLeaderInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	if leader.ID == candidateID {
+		return fmt.Errorf("%w: %v is already the leader", ErrInvalidCandidate, candidateID)
+	}
+
+	return s.requestFailover(ctx, dcs.Failover{Leader: leader.ID, Candidate: candidateID})
+}
+
+// failover names the candidate to be promoted when the leader is down. If the leader is up after all, it runs a
+// switchover to the candidate instead
+func (s *Api) failover(ctx context.Context, candidateID string) error {
+	return s.requestFailover(ctx, dcs.Failover{Candidate: candidateID})
+}
+
+// scheduleSwitchover stores a switchover to be run at the given time by whichever instance is the leader then, it does
+// not wait for it
+func (s *Api) scheduleSwitchover(ctx context.Context, candidateID string, scheduledAt time.Time) (dcs.Failover, error) {
+	if !scheduledAt.After(time.Now()) {
+		return dcs.Failover{}, fmt.Errorf("%w: %v is not in the future", ErrInvalidSchedule, scheduledAt)
+	}
+
+	scheduledAt = scheduledAt.UTC()
+	failover := dcs.Failover{Candidate: candidateID, ScheduledAt: &scheduledAt}
+	return failover, s.saveFailover(ctx, failover)
+}
+
+// cancelScheduledSwitchover removes the scheduled switchover, one which is already due may be running and is left alone
+func (s *Api) cancelScheduledSwitchover(ctx context.Context) error {
+	pending, err := s.DcsProxy.GetFailover(ctx)
+	if err != nil {
+		return err
+	}
+
+	if pending == nil || pending.ScheduledAt == nil {
+		return ErrNoScheduledSwitchover
+	}
+
+	if pending.IsDue(time.Now()) {
+		return ErrSwitchoverInProgress
+	}
+
+	return s.DcsProxy.DeleteFailover(ctx)
+}
+
+// requestFailover stores the request in the dcs, where the leader, or the instance winning the election, picks it up at
+// its next cycle, and waits for the outcome: the request is removed once the leadership was handed over or refused.
+// A paused cluster would never pick it up
+func (s *Api) requestFailover(ctx context.Context, failover dcs.Failover) error {
+	if pause, err := s.DcsProxy.GetPause(ctx); err != nil {
+		return err
+	} else if pause != nil {
+		return ErrClusterPaused
+	}
+
+	if err := s.saveFailover(ctx, failover); err != nil {
+		return err
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, switchoverTimeout)
+	defer cancel()
+
+	for {
+		pending, err := s.DcsProxy.GetFailover(timeout)
+		if err != nil {
+			s.Log.Debugf("could not get the requested failover: %v", err)
+		} else if pending == nil {
+			break
+		}
+
+		select {
+		case <-time.After(memberPollInterval):
+		case <-timeout.Done():
+			return fmt.Errorf("timed out waiting for the cluster to run the requested failover to %v", failover.Candidate)
+		}
+	}
+
+	leader, err := s.DcsProxy.GetLeaderInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	if leader.ID != failover.Candidate {
+		return fmt.Errorf("failover to %v refused by %v, see its logs", failover.Candidate, leader.Hostname)
+	}
+
+	return nil
+}
+
+// saveFailover stores the request after checking the candidate, only one request can be pending at a time
+func (s *Api) saveFailover(ctx context.Context, failover dcs.Failover) error {
+	instances, err := s.DcsProxy.GetClusterInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	isMember := false
+	for _, instance := range instances {
+		if instance.ID == failover.Candidate {
+			isMember = true
+		}
+	}
+
+	if !isMember {
+		return fmt.Errorf("%w: %v is not a member of the cluster", ErrInvalidCandidate, failover.Candidate)
+	}
+
+	pending, err := s.DcsProxy.GetFailover(ctx)
+	if err != nil {
+		return err
+	}
+
+	if pending != nil {
+		return ErrSwitchoverInProgress
+	}
+
+	return s.DcsProxy.SaveFailover(ctx, failover)
+}
+
+// failoverErrorStatus maps the errors of the switchover and failover requests to the http status
+func failoverErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSwitchoverInProgress), errors.Is(err, ErrClusterPaused):
+		return http.StatusConflict
+	case errors.Is(err, ErrNoScheduledSwitchover):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidCandidate), errors.Is(err, ErrInvalidSchedule):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
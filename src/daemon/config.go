@@ -0,0 +1,79 @@
+package daemon
+
+import (
+	"context"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+)
+
+// withClusterConfig returns the configuration with the fields set in the cluster config taking precedence
+func (c Config) withClusterConfig(clusterConfig dcs.ClusterConfig) Config {
+	if len(clusterConfig.PostgresParameters) > 0 {
+		c.PostgresParameters = clusterConfig.PostgresParameters
+	}
+	if clusterConfig.TTL != 0 {
+		c.Lease = clusterConfig.TTL
+	}
+	if clusterConfig.LoopWait != 0 {
+		c.TickDuration = clusterConfig.LoopWait
+	}
+	if clusterConfig.MaximumLagOnFailover != nil {
+		c.MaximumLagOnFailover = *clusterConfig.MaximumLagOnFailover
+	}
+	if clusterConfig.SynchronousMode != "" {
+		c.SynchronousMode = clusterConfig.SynchronousMode
+	}
+	if clusterConfig.SynchronousNodeCount != 0 {
+		c.SynchronousNodeCount = clusterConfig.SynchronousNodeCount
+	}
+	if clusterConfig.SynchronousModeStrict != nil {
+		c.SynchronousModeStrict = *clusterConfig.SynchronousModeStrict
+	}
+	if len(clusterConfig.Topology) > 0 {
+		c.Topology = clusterConfig.Topology
+	}
+
+	return c
+}
+
+// refreshConfig applies the cluster config found in the dcs and the local overrides on top of the command line flags.
+// If the dcs cannot be read the current configuration is kept
+func (d *Daemon) refreshConfig(ctx context.Context) {
+	clusterConfig, err := d.DcsProxy.GetClusterConfig(ctx)
+	if err != nil {
+		d.Log.Warningf("could not get cluster config, keeping the current one: %v", err)
+		return
+	}
+
+	effective := d.defaults.withClusterConfig(clusterConfig.Merge(d.LocalConfig))
+	if effective.Lease != d.Lease {
+		// The lease is granted when connecting to the dcs
+		d.Log.Warningf("ttl changed from %v to %v, it will be applied at the next start", d.Lease, effective.Lease)
+	}
+
+	d.Config = effective
+	d.PgConfig.Parameters = effective.PostgresParameters
+}
+
+// applyPostgresConfig rewrites postgresql.conf when the cluster config or the leader changed and makes postgres reload
+// it. Parameters needing a restart are only reported in the instance info as pending restart, postgres is never
+// restarted here
+func (d *Daemon) applyPostgresConfig(leaderHostname string) {
+	if state := d.State.Current(); state != StateRunningLeader && state != StateRunningReplica {
+		return
+	}
+
+	hasChanged, err := d.PgConfig.UpdateConfig(leaderHostname)
+	if err != nil {
+		d.Log.Errorf("could not update postgresql.conf: %v", err)
+		return
+	}
+
+	if !hasChanged {
+		return
+	}
+
+	d.Log.Infof("postgresql.conf changed, reloading postgres")
+	if err := d.Postmaster.Reload(); err != nil {
+		d.Log.Errorf("could not reload postgres: %v", err)
+	}
+}
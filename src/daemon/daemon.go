@@ -3,62 +3,362 @@ package daemon
 import (
 	"context"
 	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
 	"github.com/MatteoGioioso/seeonethirtyseven/dcs_proxy"
 	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/jackc/pgx/v5"
 	"github.com/sirupsen/logrus"
-	"os"
 	"time"
 )
 
 type Config struct {
 	TickDuration int
+	Hostname     string
+	// Lease is the one the dcs client was created with, a different ttl in the cluster config is only reported
+	Lease              int
+	PostgresParameters map[string]string
+	// MaximumLagOnFailover is the number of bytes of WAL a replica can be behind the former leader and still promote
+	MaximumLagOnFailover int64
+	// APIURL and Tags are published as they are in the instance info
+	APIURL string
+	Tags   dcs.Tags
+	// SynchronousMode is one of off, on and quorum, see manageSynchronousReplication
+	SynchronousMode      string
+	SynchronousNodeCount int
+	// SynchronousModeStrict blocks commits instead of falling back to asynchronous replication
+	SynchronousModeStrict bool
+	// Topology maps replica hostnames to the member they stream from, it takes precedence over the replicatefrom tag
+	Topology map[string]string
 }
 
 type Daemon struct {
 	PgConfig   postgresql.Config
 	Postmaster postgresql.Postmaster
 	DcsProxy   dcs_proxy.ProxyImpl
+	State      *StateMachine
+	Restarts   *RestartScheduler
 	Log        *logrus.Entry
 	Config
+
+	// LocalConfig overrides the cluster config stored in the dcs for this node only
+	LocalConfig dcs.ClusterConfig
+
+	// lastLeaderLSN is the last WAL position published by the leader, it is the reference to compute the lag once the
+	// leader is gone
+	lastLeaderLSN  postgresql.LSN
+	leaderHostname string
+	// upstreamHostname is the member postgres streams from, the leader unless the replicatefrom tag is set
+	upstreamHostname string
+	// paused is the last known value of the cluster pause flag
+	paused bool
+	// staleSlotsSince is when each replication slot was first found stale, see staleReplicationSlots
+	staleSlotsSince map[string]time.Time
+	// defaults is the configuration coming from the command line flags, the cluster config is applied on top of it
+	defaults Config
 }
 
+// Start runs the daemon loop: it wakes up at every tick and, without waiting for the next tick, as soon as the dcs
+// reports a leadership change
 func (d *Daemon) Start(ctx context.Context) error {
-	tick := time.NewTicker(time.Duration(d.TickDuration) * time.Second)
+	d.defaults = d.Config
+	tickDuration := time.Duration(d.TickDuration) * time.Second
+	tick := time.NewTicker(tickDuration)
 	defer tick.Stop()
 
+	leaderChanges := d.DcsProxy.ObserveLeader(ctx)
+
 loop:
 	for {
 		select {
 		case <-tick.C:
-			role, err := d.DcsProxy.GetRole(ctx)
-			if err != nil {
-				// TODO add possibility to keep running as replica
-				return err
+			if leaderChanges == nil {
+				leaderChanges = d.DcsProxy.ObserveLeader(ctx)
 			}
-
-			if role == postgresql.Leader {
-				if err := d.LeaderFunc(ctx); err != nil {
-					return err
-				}
-			}
-
-			if role == postgresql.Replica {
-				if err := d.ReplicaFunc(ctx); err != nil {
-					return err
-				}
+		case leaderID, ok := <-leaderChanges:
+			if !ok {
+				d.Log.Warningf("leader watch was closed, relying on the ticker until the next tick")
+				leaderChanges = nil
+				continue
 			}
 
-			d.Log.Infof("I am the %v", role)
-			if err := d.DcsProxy.SaveInstanceInfo(ctx, role); err != nil {
-				d.Log.Errorf("Could not sync instance info: %v", err)
-			}
+			d.Log.Infof("leadership changed, new leader: %v", leaderID)
+			tick.Reset(tickDuration)
 		case <-ctx.Done():
 			d.Log.Infof("Stopping daemon loop")
 			tick.Stop()
 			break loop
 		}
+
+		if err := d.runCycle(ctx); err != nil {
+			return err
+		}
+
+		// loop_wait may have been changed in the cluster config
+		if newTickDuration := time.Duration(d.TickDuration) * time.Second; newTickDuration != tickDuration {
+			d.Log.Infof("loop wait changed from %v to %v", tickDuration, newTickDuration)
+			tickDuration = newTickDuration
+			tick.Reset(tickDuration)
+		}
+	}
+
+	return nil
+}
+
+func (d *Daemon) runCycle(ctx context.Context) error {
+	d.refreshConfig(ctx)
+
+	role, err := d.DcsProxy.GetRole(ctx)
+	if err != nil {
+		// TODO add possibility to keep running as replica
+		return err
+	}
+
+	if d.isPaused(ctx) {
+		d.Log.Infof("cluster is paused, observing only: I am the %v", role)
+		// Neither the replication slots nor primary_conninfo are touched while paused
+		if role == postgresql.Replica {
+			d.refreshLeader(ctx)
+		}
+
+		d.publishInstanceInfo(ctx, role)
+		return nil
+	}
+
+	if role == postgresql.Leader {
+		if err := d.LeaderFunc(ctx); err != nil {
+			d.setState(StateError, err.Error())
+			return err
+		}
+
+		if d.runSwitchover(ctx) {
+			// The leadership was handed over, the instance rejoins the cluster as replica right away
+			role = postgresql.Replica
+		} else {
+			d.applyPostgresConfig("")
+			d.dropStaleReplicationSlots(ctx)
+		}
+	}
+
+	if role == postgresql.Replica {
+		if err := d.ReplicaFunc(ctx); err != nil {
+			d.setState(StateError, err.Error())
+			return err
+		}
+
+		d.observeLeader(ctx)
+		if d.upstreamHostname != "" {
+			d.applyPostgresConfig(d.upstreamHostname)
+		}
+		d.dropStaleReplicationSlots(ctx)
+	}
+
+	// A failed restart must not stop seeone, the next cycle starts postgres again if it is down
+	if err := d.runScheduledRestart(ctx, role); err != nil {
+		d.Log.Errorf("could not restart postgres: %v", err)
+		d.setState(StateError, err.Error())
+	}
+
+	d.Log.Infof("I am the %v", role)
+	d.publishInstanceInfo(ctx, role)
+	return nil
+}
+
+func (d *Daemon) publishInstanceInfo(ctx context.Context, role string) {
+	if err := d.DcsProxy.SaveInstanceInfo(ctx, d.getInstanceInfo(ctx, role)); err != nil {
+		d.Log.Errorf("Could not sync instance info: %v", err)
+	}
+}
+
+// isPaused reads the cluster pause flag, the last known value is kept when the dcs cannot be read
+func (d *Daemon) isPaused(ctx context.Context) bool {
+	pause, err := d.DcsProxy.GetPause(ctx)
+	if err != nil {
+		d.Log.Warningf("could not get the cluster pause flag: %v", err)
+		return d.paused
+	}
+
+	if isPaused := pause != nil; isPaused != d.paused {
+		if isPaused {
+			d.Log.Infof("cluster paused since %v: %v", pause.Since, pause.Reason)
+		} else {
+			d.Log.Infof("cluster resumed")
+		}
+
+		d.paused = isPaused
+	}
+
+	return d.paused
+}
+
+// getInstanceInfo collects the instance status to be published in the dcs, what can be read only from a running
+// postgres is left empty otherwise
+func (d *Daemon) getInstanceInfo(ctx context.Context, role string) dcs.InstanceInfo {
+	info := dcs.InstanceInfo{
+		Role:          role,
+		State:         string(d.State.Current()),
+		PostgresState: d.Postmaster.GetState(),
+		APIURL:        d.APIURL,
+		Tags:          d.Tags,
+		LastHeartbeat: time.Now().UTC(),
+	}
+	if role == postgresql.Replica {
+		info.Upstream = d.upstreamHostname
+	}
+	if info.PostgresState != postgresql.PostgresStateRunning {
+		return info
+	}
+
+	received, replayed, err := d.Postmaster.GetWALPositions(ctx)
+	if err != nil {
+		d.Log.Warningf("could not get WAL positions: %v", err)
+	} else {
+		info.ReceivedLSN = received
+		info.ReplayedLSN = replayed
+		if role == postgresql.Replica {
+			info.Lag = d.lastLeaderLSN.Diff(received)
+		}
+	}
+
+	if timeline, err := d.Postmaster.GetLocalTimeline(ctx); err != nil {
+		d.Log.Warningf("could not get timeline: %v", err)
+	} else {
+		info.Timeline = timeline
+	}
+
+	if version, err := d.Postmaster.GetVersion(ctx); err != nil {
+		d.Log.Warningf("could not get postgres version: %v", err)
+	} else {
+		info.PostgresVersion = version
+	}
+
+	if pendingRestart, err := d.Postmaster.GetPendingRestart(ctx); err != nil {
+		d.Log.Warningf("could not get parameters pending restart: %v", err)
+	} else {
+		info.PendingRestart = len(pendingRestart) > 0
+		info.PendingRestartParameters = pendingRestart
+	}
+
+	return info
+}
+
+// observeLeader remembers the leader hostname and its WAL position, as seen by a replica, and picks the member to stream
+// from
+func (d *Daemon) observeLeader(ctx context.Context) {
+	if !d.refreshLeader(ctx) {
+		return
+	}
+
+	instances, err := d.DcsProxy.GetClusterInstances(ctx)
+	if err != nil {
+		d.Log.Debugf("could not get cluster instances: %v", err)
+		return
+	}
+
+	upstream := pickUpstream(d.Hostname, d.replicateFrom(), instances, d.leaderHostname)
+	if upstream == d.upstreamHostname {
+		return
+	}
+
+	// The slot must exist on the new upstream before postgres connects to it
+	if err := d.createReplicationSlot(ctx, upstream); err != nil {
+		d.Log.Warningf("not streaming from %v yet: %v", upstream, err)
+		return
+	}
+
+	if d.upstreamHostname != "" {
+		d.Log.Infof("streaming from %v instead of %v", upstream, d.upstreamHostname)
+	}
+	d.upstreamHostname = upstream
+}
+
+// refreshLeader records the hostname and the WAL position of the leader, it returns false if the leader is unknown
+func (d *Daemon) refreshLeader(ctx context.Context) bool {
+	// The leader is the holder of the leader key: during a switchover the former leader still publishes itself as leader
+	// for a cycle
+	leaderInfo, err := d.DcsProxy.GetLeaderInfo(ctx)
+	if err != nil {
+		d.Log.Debugf("could not get leader info: %v", err)
+		return false
+	}
+
+	d.leaderHostname = leaderInfo.Hostname
+	// WAL positions only move forward, even across timelines: a new leader not promoted yet must not lower the reference
+	if leaderInfo.ReceivedLSN > d.lastLeaderLSN {
+		d.lastLeaderLSN = leaderInfo.ReceivedLSN
+	}
+
+	return true
+}
+
+// isFailoverAllowed checks the instance against the other members before promoting it, see checkFailoverCandidate
+func (d *Daemon) isFailoverAllowed(ctx context.Context, self dcs.InstanceInfo) (bool, string, error) {
+	instances, err := d.DcsProxy.GetClusterInstances(ctx)
+	if err != nil {
+		return false, "", err
+	}
+
+	if d.Tags.NoFailover() {
+		return false, fmt.Sprintf("member is tagged %v", d.Tags.NoFailoverTag()), nil
+	}
+
+	if d.SynchronousMode != SynchronousModeOff {
+		syncState, err := d.DcsProxy.GetSyncState(ctx)
+		if err != nil {
+			return false, "", err
+		}
+
+		if isAllowed, reason := checkSyncCandidate(self, instances, syncState); !isAllowed {
+			return false, reason, nil
+		}
+
+		// Asynchronous replicas may have received WAL the synchronous ones did not, but never a commit: only the
+		// synchronous standbys are compared
+		syncMembers := make([]dcs.InstanceInfo, 0)
+		for _, instance := range instances {
+			if syncState.IsMember(instance.Hostname) {
+				syncMembers = append(syncMembers, instance)
+			}
+		}
+		instances = syncMembers
+	}
+
+	isAllowed, reason := checkFailoverCandidate(self, instances, d.lastLeaderLSN, d.MaximumLagOnFailover)
+	return isAllowed, reason, nil
+}
+
+// isManualFailoverAllowed checks the failover candidate chosen by the operator: the other members are not compared, but
+// it must not lose commits acknowledged by the former leader
+func (d *Daemon) isManualFailoverAllowed(ctx context.Context, self dcs.InstanceInfo) (bool, string, error) {
+	if d.SynchronousMode != SynchronousModeOff {
+		syncState, err := d.DcsProxy.GetSyncState(ctx)
+		if err != nil {
+			return false, "", err
+		}
+
+		if !syncState.IsMember(self.Hostname) {
+			return false, fmt.Sprintf("%v is not a synchronous standby of the former leader", self.Hostname), nil
+		}
+	}
+
+	isAllowed, reason := checkFailoverCandidate(self, nil, d.lastLeaderLSN, d.MaximumLagOnFailover)
+	return isAllowed, reason, nil
+}
+
+// getSelfInfo is the instance info of a replica about to promote, as the other members see it in the dcs
+func (d *Daemon) getSelfInfo(ctx context.Context) dcs.InstanceInfo {
+	self := d.getInstanceInfo(ctx, postgresql.Replica)
+	self.ID = d.PgConfig.InstanceID
+	self.Hostname = d.Hostname
+	return self
+}
+
+// yieldLeadership resigns and joins the election again, at the back of the queue, letting another candidate win
+func (d *Daemon) yieldLeadership(ctx context.Context) error {
+	if err := d.DcsProxy.Demote(ctx); err != nil {
+		return fmt.Errorf("could not yield leadership: %v", err)
 	}
 
+	d.DcsProxy.StartElection(ctx)
 	return nil
 }
 
@@ -73,20 +373,29 @@ func (d *Daemon) LeaderFunc(ctx context.Context) error {
 	}
 
 	if isDataDirEmpty {
+		d.setState(StateBootstrapping, "data directory is empty, initializing a new cluster")
 		if err := d.BootstrapLeader(ctx); err != nil {
 			return err
 		}
 
+		d.setState(StateStarting, "cluster initialized")
 		if err := d.Postmaster.Start(); err != nil {
 			return err
 		}
 
-		connect, err := d.Postmaster.Connect(ctx)
+		connect, release, err := d.Postmaster.AcquireConn(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = d.PgConfig.CreateReplicationUser(ctx, connect)
+		release()
 		if err != nil {
 			return err
 		}
 
-		return d.PgConfig.CreateReplicationUser(ctx, connect)
+		d.setState(StateRunningLeader, "cluster bootstrapped")
+		return nil
 	} else if d.Postmaster.IsRunning() {
 		d.Log.Debugf("postgres is running, check if its role is consistent")
 
@@ -100,6 +409,7 @@ func (d *Daemon) LeaderFunc(ctx context.Context) error {
 				"current postgres is in recovery, but is supposed to be the %v, possible failover, trying to promote this instance",
 				postgresql.Leader,
 			)
+			d.setState(StatePromoting, "instance holds the leadership but postgres is in recovery")
 
 			// Before promoting we MUST make sure that there is no other postgres process running in non-recovery mode present in the cluster
 			isThereOrphanLeader, err := d.IsThereOrphanLeader(ctx)
@@ -109,22 +419,65 @@ func (d *Daemon) LeaderFunc(ctx context.Context) error {
 
 			if isThereOrphanLeader {
 				d.Log.Errorf("an orphan leader was found, we cannot promote the current instance")
+				d.setState(StateRunningReplica, "an orphan leader was found, promotion refused")
 				return nil
 			}
 
+			manualFailover, err := d.getManualFailover(ctx)
+			if err != nil {
+				return fmt.Errorf("could not get the requested failover: %v", err)
+			}
+
+			if manualFailover != nil && manualFailover.Candidate != d.PgConfig.InstanceID {
+				if d.handOverManualFailover(ctx, manualFailover) {
+					d.setState(StateRunningReplica, fmt.Sprintf("leadership handed over to failover candidate %v", manualFailover.Candidate))
+					return nil
+				}
+
+				manualFailover = nil
+			}
+
+			var isFailoverAllowed bool
+			var reason string
+			if manualFailover != nil {
+				isFailoverAllowed, reason, err = d.isManualFailoverAllowed(ctx, d.getSelfInfo(ctx))
+				if err := d.DcsProxy.DeleteFailover(ctx); err != nil {
+					d.Log.Errorf("could not delete the requested failover: %v", err)
+				}
+			} else {
+				isFailoverAllowed, reason, err = d.isFailoverAllowed(ctx, d.getSelfInfo(ctx))
+			}
+			if err != nil {
+				return fmt.Errorf("could not establish if the instance is the healthiest candidate: %v", err)
+			}
+
+			if !isFailoverAllowed {
+				d.Log.Warningf("promotion refused, yielding the leadership: %v", reason)
+				d.setState(StateRunningReplica, fmt.Sprintf("promotion refused: %v", reason))
+				return d.yieldLeadership(ctx)
+			}
+
 			if err := d.Postmaster.Promote(); err != nil {
 				return fmt.Errorf("could not promote postgres: %v", err)
 			}
 
 			d.Log.Infof("postgres was promoted to %v", postgresql.Leader)
-			return nil
+			d.setState(StateRunningLeader, "postgres was promoted")
 		} else {
 			d.Log.Debugf("postgres status is good: running as %v", postgresql.Leader)
-			return nil
+			d.setState(StateRunningLeader, "postgres is running as leader")
+		}
+
+		// A failure must not stop the leader from running, the next cycle will try again
+		if err := d.manageSynchronousReplication(ctx); err != nil {
+			d.Log.Errorf("could not manage synchronous replication: %v", err)
 		}
+
+		return nil
 	} else {
 		// Postgres is not running but the data directory is not empty
 		d.Log.Debugf("postgres is not running: trying to start")
+		d.setState(StateStarting, "postgres is not running")
 		if err := d.Postmaster.Start(); err != nil {
 			return err
 		}
@@ -145,6 +498,7 @@ func (d *Daemon) ReplicaFunc(ctx context.Context) error {
 
 	if isDataDirEmpty {
 		d.Log.Debugf("postgres data directory is empty")
+		d.setState(StateBootstrapping, "data directory is empty, cloning the leader")
 		return d.bootstrapAndStartReplica(ctx)
 	} else if d.Postmaster.IsRunning() {
 		d.Log.Debugf("postgres is running, check if its role is consistent")
@@ -156,6 +510,7 @@ func (d *Daemon) ReplicaFunc(ctx context.Context) error {
 
 		if isInRecovery {
 			d.Log.Debugf("postgres status is good: running and in recovery mode")
+			d.setState(StateRunningReplica, "postgres is running in recovery mode")
 			return nil
 		} else {
 			// TODO if we find ourself in this situation we could possibly have a temporary split brain (crash, kill or smart shutdown?)
@@ -164,19 +519,61 @@ func (d *Daemon) ReplicaFunc(ctx context.Context) error {
 			// from such a case.
 			// I will still keep this just in case
 			d.Log.Errorf("postgres is running not in recovery mode, but it is supposed to be a replica, POSSIBLE CORRUPTION: stopping")
+			d.setState(StateDemoting, "postgres is running as leader, but the instance is a replica")
 			if err := d.Postmaster.Stop(postgresql.StopModeFast); err != nil {
 				return err
 			}
 
-			return d.bootstrapAndStartReplica(ctx)
+			return d.rewindAndStartReplica(ctx)
 		}
 	} else {
-		// If postgres is not running but the data directory is not empty, we cannot risk to start the process
+		canBeReused, err := d.canReuseDataDir()
+		if err != nil {
+			d.Log.Warningf("could not inspect the data directory: %v", err)
+		} else if canBeReused {
+			return d.rewindAndStartReplica(ctx)
+		}
+
+		// If postgres is not running and the data directory cannot be recognised, we cannot risk to start the process
 		// because it might NOT be in recovery mode, therefore we proceed to empty the data folder and make a base backup
+		d.setState(StateReinitializing, "postgres is not running and its data directory cannot be trusted")
 		return d.bootstrapAndStartReplica(ctx)
 	}
 }
 
+// canReuseDataDir tells if a stopped data directory can be started again as replica without a new base backup: either
+// it belongs to a former leader, which will be rewound if needed, or to a replica which was left in recovery mode
+func (d *Daemon) canReuseDataDir() (bool, error) {
+	controlData, err := d.Postmaster.ControlData()
+	if err != nil {
+		return false, err
+	}
+
+	if controlData.WasLeader() {
+		d.Log.Infof("postgres is not running and its data directory belongs to a former leader")
+		return true, nil
+	}
+
+	if !controlData.WasReplica() {
+		d.Log.Debugf("unexpected cluster state in pg_controldata: %v", controlData.ClusterState())
+		return false, nil
+	}
+
+	// A replica data directory without standby.signal was being promoted, or was tampered with
+	hasStandbySignal, err := d.Postmaster.HasStandbySignal()
+	if err != nil {
+		return false, err
+	}
+
+	if !hasStandbySignal {
+		d.Log.Warningf("data directory was in recovery mode, but standby.signal is missing")
+		return false, nil
+	}
+
+	d.Log.Infof("postgres is not running and its data directory belongs to a replica")
+	return true, nil
+}
+
 func (d *Daemon) bootstrapAndStartReplica(ctx context.Context) error {
 	leaderInfo, err := d.DcsProxy.GetLeaderInfo(ctx)
 	if err != nil {
@@ -187,24 +584,157 @@ func (d *Daemon) bootstrapAndStartReplica(ctx context.Context) error {
 		return fmt.Errorf("could not BlockAndWaitForLeader: %v", err)
 	}
 
+	source := leaderInfo.Hostname
+	upstream := leaderInfo.Hostname
+	if instances, err := d.DcsProxy.GetClusterInstances(ctx); err != nil {
+		d.Log.Warningf("could not get cluster instances, cloning and streaming from the leader: %v", err)
+	} else {
+		source = pickCloneSource(d.Hostname, instances, leaderInfo.Hostname)
+		upstream = pickUpstream(d.Hostname, d.replicateFrom(), instances, leaderInfo.Hostname)
+	}
+
+	if err := d.createReplicationSlot(ctx, upstream); err != nil {
+		return err
+	}
+
+	if err := d.BootstrapReplica(ctx, source, upstream); err != nil {
+		return fmt.Errorf("could not BootstrapReplica: %v", err)
+	}
+
+	d.upstreamHostname = upstream
+	d.setState(StateStarting, fmt.Sprintf("data directory cloned from %v", source))
+	if err := d.Postmaster.Start(); err != nil {
+		return fmt.Errorf("could not Start postgres process: %v", err)
+	}
+
+	if err := d.Postmaster.WaitForStart(); err != nil {
+		return err
+	}
+
+	d.setState(StateRunningReplica, "postgres started in recovery mode")
+	return nil
+}
+
+// setState moves the state machine, an invalid transition is a bug in the daemon logic: it is logged but it must not
+// stop the loop
+func (d *Daemon) setState(state State, reason string) {
+	if err := d.State.Transition(state, reason); err != nil {
+		d.Log.Errorf("%v", err)
+	}
+}
+
+// rewindAndStartReplica rejoins the cluster as replica keeping the data directory: if its timeline diverged from the
+// leader one, because the instance was the leader or replayed WAL the new leader never received, it is re-synchronized
+// with pg_rewind. A new base backup is made only when pg_rewind fails
+func (d *Daemon) rewindAndStartReplica(ctx context.Context) error {
+	leaderInfo, err := d.DcsProxy.GetLeaderInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("could not GetLeaderInfo: %v", err)
+	}
+
+	if err := d.Postmaster.BlockAndWaitForLeader(leaderInfo.Hostname); err != nil {
+		return fmt.Errorf("could not BlockAndWaitForLeader: %v", err)
+	}
+
 	conn, err := d.Postmaster.ConnectTo(ctx, leaderInfo.Hostname)
 	if err != nil {
 		return fmt.Errorf("could not ConnectTo leader at host %v: %v", leaderInfo.Hostname, err)
 	}
+	defer conn.Close(ctx)
 
-	if err := d.PgConfig.CreateReplicationSlot(ctx, conn, os.Getenv("HOSTNAME")); err != nil {
-		return fmt.Errorf("could not CreateReplicationSlot: %v", err)
+	upstream := d.getUpstream(ctx, leaderInfo.Hostname)
+	if err := d.createReplicationSlot(ctx, upstream); err != nil {
+		return err
 	}
 
-	if err := d.BootstrapReplica(ctx, leaderInfo.Hostname); err != nil {
-		return fmt.Errorf("could not BootstrapReplica: %v", err)
+	hasDiverged, err := d.hasDiverged(ctx, conn)
+	if err != nil {
+		d.Log.Warningf("could not compare the WAL with the leader, falling back to a new base backup: %v", err)
+		d.setState(StateReinitializing, "timeline divergence could not be established")
+		return d.bootstrapAndStartReplica(ctx)
 	}
 
+	if hasDiverged {
+		d.setState(StateRewinding, fmt.Sprintf("timeline diverged from leader %v", leaderInfo.Hostname))
+		if err := d.Postmaster.Rewind(leaderInfo.Hostname); err != nil {
+			d.Log.Warningf("could not rewind, falling back to a new base backup: %v", err)
+			d.setState(StateReinitializing, "pg_rewind failed")
+			return d.bootstrapAndStartReplica(ctx)
+		}
+	}
+
+	return d.startReplica(upstream)
+}
+
+// hasDiverged compares the local WAL with the leader one. The leader is waited for until it is out of recovery: a
+// leader which won the election but is not promoted yet is still on the former timeline
+func (d *Daemon) hasDiverged(ctx context.Context, leaderConn *pgx.Conn) (bool, error) {
+	leaderLSN, err := d.Postmaster.WaitForPromotion(ctx, leaderConn)
+	if err != nil {
+		return false, fmt.Errorf("leader did not get out of recovery: %v", err)
+	}
+
+	leaderTimeline, err := d.Postmaster.GetTimeline(ctx, leaderConn)
+	if err != nil {
+		return false, err
+	}
+
+	controlData, err := d.Postmaster.ControlData()
+	if err != nil {
+		return false, err
+	}
+
+	localTimeline, err := controlData.Timeline()
+	if err != nil {
+		return false, err
+	}
+
+	localLSN, err := controlData.CheckpointLSN()
+	if err != nil {
+		return false, err
+	}
+
+	d.Log.Debugf(
+		"local timeline: %v at %v, leader timeline: %v at %v",
+		localTimeline, localLSN, leaderTimeline, leaderLSN,
+	)
+	return walHasDiverged(localTimeline, localLSN, leaderTimeline, leaderLSN), nil
+}
+
+// walHasDiverged tells if the local WAL cannot be continued by streaming from the leader. A promotion always creates a
+// new timeline, pg_rewind is cheap when the local WAL ends before the fork point. On the same timeline the local WAL
+// must not go past the leader one
+func walHasDiverged(localTimeline int, localLSN postgresql.LSN, leaderTimeline int, leaderLSN postgresql.LSN) bool {
+	if localTimeline != leaderTimeline {
+		return true
+	}
+
+	return localLSN > leaderLSN
+}
+
+// startReplica starts postgres in recovery mode on top of the existing data directory, streaming from the upstream
+func (d *Daemon) startReplica(upstreamHostname string) error {
+	d.Log.Debugf("creating postgresql.conf")
+	if err := d.PgConfig.CreateConfig(upstreamHostname); err != nil {
+		return err
+	}
+
+	if err := d.Postmaster.CreateStandbySignal(); err != nil {
+		return err
+	}
+
+	d.upstreamHostname = upstreamHostname
+	d.setState(StateStarting, fmt.Sprintf("starting as replica of %v", upstreamHostname))
 	if err := d.Postmaster.Start(); err != nil {
 		return fmt.Errorf("could not Start postgres process: %v", err)
 	}
 
-	return d.Postmaster.WaitForStart()
+	if err := d.Postmaster.WaitForStart(); err != nil {
+		return err
+	}
+
+	d.setState(StateRunningReplica, "postgres started in recovery mode")
+	return nil
 }
 
 func (d *Daemon) BootstrapLeader(ctx context.Context) error {
@@ -222,18 +752,20 @@ func (d *Daemon) BootstrapLeader(ctx context.Context) error {
 	return d.PgConfig.CreateConfig("")
 }
 
-func (d *Daemon) BootstrapReplica(ctx context.Context, leaderHostname string) error {
+// BootstrapReplica clones the data directory from the source, which is either the leader or a replica tagged
+// clonefrom, and configures postgres to stream from the upstream
+func (d *Daemon) BootstrapReplica(ctx context.Context, sourceHostname string, upstreamHostname string) error {
 	d.Log.Debugf("bootstrapping")
 	if err := d.Postmaster.EmptyDataDir(); err != nil {
 		return err
 	}
 
-	if err := d.Postmaster.MakeBaseBackup(leaderHostname); err != nil {
+	if err := d.Postmaster.MakeBaseBackup(sourceHostname); err != nil {
 		return err
 	}
 
 	d.Log.Debugf("creating postgresql.conf")
-	if err := d.PgConfig.CreateConfig(leaderHostname); err != nil {
+	if err := d.PgConfig.CreateConfig(upstreamHostname); err != nil {
 		return err
 	}
 
@@ -253,13 +785,27 @@ func (d *Daemon) IsThereOrphanLeader(ctx context.Context) (bool, error) {
 
 	for _, instance := range instances {
 		d.Log.Debugf("checking hostname %v with instance id %v", instance.Hostname, instance.ID)
-		conn, err := d.Postmaster.ConnectTo(ctx, instance.Hostname)
-		if err != nil {
-			return true, err
+
+		var conn *pgx.Conn
+		// This is how a leader handing over the leadership publishes itself, but the instance info can be stale: postgres
+		// is still probed, and only a failed connection proves it stopped
+		if instance.PostgresState == postgresql.PostgresStateStopped {
+			conn, err = d.Postmaster.ProbeConnectTo(ctx, instance.Hostname)
+			if err != nil {
+				d.Log.Debugf("hostname %v with instance id %v, is stopped: %v", instance.Hostname, instance.ID, err)
+				continue
+			}
+		} else {
+			conn, err = d.Postmaster.ConnectTo(ctx, instance.Hostname)
+			if err != nil {
+				return true, err
+			}
 		}
 
 		var isInRecovery bool
-		if err := conn.QueryRow(ctx, "select pg_is_in_recovery()").Scan(&isInRecovery); err != nil {
+		err = conn.QueryRow(ctx, "select pg_is_in_recovery()").Scan(&isInRecovery)
+		conn.Close(ctx)
+		if err != nil {
 			return true, err
 		}
 
@@ -0,0 +1,106 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/sirupsen/logrus"
+)
+
+func TestWALHasDiverged(t *testing.T) {
+	tests := []struct {
+		name           string
+		localTimeline  int
+		localLSN       postgresql.LSN
+		leaderTimeline int
+		leaderLSN      postgresql.LSN
+		want           bool
+	}{
+		{
+			name:          "replica behind the leader on the same timeline",
+			localTimeline: 1, localLSN: 100, leaderTimeline: 1, leaderLSN: 200,
+		},
+		{
+			name:          "replica caught up with the leader",
+			localTimeline: 1, localLSN: 200, leaderTimeline: 1, leaderLSN: 200,
+		},
+		{
+			name:          "former leader with WAL the leader never received",
+			localTimeline: 1, localLSN: 300, leaderTimeline: 1, leaderLSN: 200,
+			want: true,
+		},
+		{
+			name:          "leader promoted on a new timeline",
+			localTimeline: 1, localLSN: 100, leaderTimeline: 2, leaderLSN: 200,
+			want: true,
+		},
+		{
+			name:          "local timeline ahead of the leader",
+			localTimeline: 3, localLSN: 100, leaderTimeline: 2, leaderLSN: 200,
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := walHasDiverged(tt.localTimeline, tt.localLSN, tt.leaderTimeline, tt.leaderLSN)
+			if got != tt.want {
+				t.Errorf("walHasDiverged = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A member which published a stopped postgres is probed once, the failed connection proves it stopped
+func TestIsThereOrphanLeaderSkipsUnreachableStoppedMember(t *testing.T) {
+	store := dcs.NewMemoryStore()
+	// The hostname is the instance id, 192.0.2.0/24 is reserved for documentation and nothing answers there
+	stopped := newTestDaemon(t, store, "192.0.2.1", nil)
+	d := newTestDaemon(t, store, "a", nil)
+	d.Postmaster = postgresql.Postmaster{Log: logrus.NewEntry(logrus.New())}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	info := dcs.InstanceInfo{Role: postgresql.Leader, PostgresState: postgresql.PostgresStateStopped}
+	if err := stopped.DcsProxy.SaveInstanceInfo(ctx, info); err != nil {
+		t.Fatalf("SaveInstanceInfo: %v", err)
+	}
+
+	orphan, err := d.IsThereOrphanLeader(ctx)
+	if err != nil {
+		t.Fatalf("IsThereOrphanLeader: %v", err)
+	}
+	if orphan {
+		t.Fatalf("an unreachable stopped member was reported as an orphan leader")
+	}
+}
+
+func TestRefreshLeader(t *testing.T) {
+	ctx := context.Background()
+	store := dcs.NewMemoryStore()
+	leader := newTestDaemon(t, store, "a", nil)
+	replica := newTestDaemon(t, store, "b", nil)
+
+	if err := leader.DcsProxy.SaveInstanceInfo(ctx, dcs.InstanceInfo{Role: postgresql.Leader, ReceivedLSN: 10000}); err != nil {
+		t.Fatalf("SaveInstanceInfo: %v", err)
+	}
+	leader.DcsProxy.StartElection(ctx)
+	waitForNewLeader(t, replica, "")
+
+	// The leader published a position older than the one already observed, a new leader not promoted yet does that
+	replica.lastLeaderLSN = 12000
+	replica.upstreamHostname = "c"
+	if !replica.refreshLeader(ctx) {
+		t.Fatalf("the leader was not refreshed")
+	}
+	if replica.leaderHostname != "a" || replica.lastLeaderLSN != 12000 {
+		t.Fatalf("unexpected leader %v at %v", replica.leaderHostname, replica.lastLeaderLSN)
+	}
+	if replica.upstreamHostname != "c" {
+		t.Fatalf("refreshing the leader changed the upstream to %v", replica.upstreamHostname)
+	}
+}
@@ -0,0 +1,95 @@
+package daemon
+
+import (
+	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+)
+
+// checkFailoverCandidate decides if the instance, which won the election while being a replica, is allowed to promote.
+// leaderLSN is the last WAL position published by the former leader, zero when unknown. The instance defers to a
+// healthy replica with a higher failover priority and an acceptable lag and, with the same priority, to a replica which
+// received more WAL. It returns the reason of the refusal, if any
+func checkFailoverCandidate(self dcs.InstanceInfo, members []dcs.InstanceInfo, leaderLSN postgresql.LSN, maximumLag int64) (bool, string) {
+	if lag := leaderLSN.Diff(self.ReceivedLSN); lag > maximumLag {
+		return false, fmt.Sprintf("lag of %v bytes exceeds maximum_lag_on_failover of %v bytes", lag, maximumLag)
+	}
+
+	selfPriority := self.Tags.FailoverPriority()
+	for _, member := range members {
+		// A member tagged nofailover cannot promote, it must not prevent the others from doing it
+		if member.ID == self.ID || member.Role != postgresql.Replica || member.Tags.NoFailover() {
+			continue
+		}
+
+		memberPriority := member.Tags.FailoverPriority()
+		if memberPriority > selfPriority && isRunningReplica(member) && leaderLSN.Diff(member.ReceivedLSN) <= maximumLag {
+			return false, fmt.Sprintf(
+				"member %v has a higher failover priority: %v against %v",
+				member.ID,
+				memberPriority,
+				selfPriority,
+			)
+		}
+
+		if memberPriority == selfPriority && member.ReceivedLSN > self.ReceivedLSN {
+			return false, fmt.Sprintf(
+				"member %v received more WAL: %v against %v",
+				member.ID,
+				member.ReceivedLSN,
+				self.ReceivedLSN,
+			)
+		}
+	}
+
+	return true, ""
+}
+
+// checkSyncCandidate makes sure that, in synchronous mode, the instance has every commit acknowledged by the former
+// leader: it must be one of its synchronous standbys and, with a quorum, enough of them must be available for the most
+// advanced one to have every commit
+func checkSyncCandidate(self dcs.InstanceInfo, members []dcs.InstanceInfo, syncState dcs.SyncState) (bool, string) {
+	if !syncState.IsMember(self.Hostname) {
+		return false, fmt.Sprintf("%v is not a synchronous standby of the former leader", self.Hostname)
+	}
+
+	available := 1
+	for _, member := range members {
+		if member.ID != self.ID && syncState.IsMember(member.Hostname) {
+			available++
+		}
+	}
+
+	if required := len(syncState.Members) - syncState.Quorum + 1; available < required {
+		return false, fmt.Sprintf(
+			"only %v of %v synchronous standbys are available, %v are needed",
+			available,
+			len(syncState.Members),
+			required,
+		)
+	}
+
+	return true, ""
+}
+
+// checkSwitchoverCandidate decides if the leader can hand over the leadership to the candidate: it must be a healthy
+// running replica close enough to the leader current WAL position
+func checkSwitchoverCandidate(candidate dcs.InstanceInfo, leaderLSN postgresql.LSN, maximumLag int64) (bool, string) {
+	if candidate.Role != postgresql.Replica {
+		return false, fmt.Sprintf("%v is not a replica", candidate.Hostname)
+	}
+
+	if candidate.Tags.NoFailover() {
+		return false, fmt.Sprintf("%v is tagged %v", candidate.Hostname, candidate.Tags.NoFailoverTag())
+	}
+
+	if candidate.State != string(StateRunningReplica) || candidate.PostgresState != postgresql.PostgresStateRunning {
+		return false, fmt.Sprintf("%v is not running as replica: %v", candidate.Hostname, candidate.State)
+	}
+
+	if lag := leaderLSN.Diff(candidate.ReceivedLSN); lag > maximumLag {
+		return false, fmt.Sprintf("lag of %v bytes exceeds maximum_lag_on_failover of %v bytes", lag, maximumLag)
+	}
+
+	return true, ""
+}
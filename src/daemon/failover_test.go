@@ -0,0 +1,572 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs_proxy"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/sirupsen/logrus"
+)
+
+const testMaximumLag = 1000
+
+func runningReplica(id string, receivedLSN postgresql.LSN, tags dcs.Tags) dcs.InstanceInfo {
+	return dcs.InstanceInfo{
+		ID:            id,
+		Hostname:      id,
+		Role:          postgresql.Replica,
+		State:         string(StateRunningReplica),
+		PostgresState: postgresql.PostgresStateRunning,
+		ReceivedLSN:   receivedLSN,
+		Tags:          tags,
+	}
+}
+
+func TestCheckFailoverCandidate(t *testing.T) {
+	stopped := runningReplica("other", 10000, dcs.Tags{dcs.TagFailoverPriority: "2"})
+	stopped.State = string(StateStopped)
+	stopped.PostgresState = postgresql.PostgresStateStopped
+
+	tests := []struct {
+		name      string
+		self      dcs.InstanceInfo
+		members   []dcs.InstanceInfo
+		leaderLSN postgresql.LSN
+		want      bool
+	}{
+		{
+			name:      "only replica",
+			self:      runningReplica("self", 10000, nil),
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name:      "unknown leader position",
+			self:      runningReplica("self", 10000, nil),
+			leaderLSN: 0,
+			want:      true,
+		},
+		{
+			name:      "lag within maximum_lag_on_failover",
+			self:      runningReplica("self", 10000-testMaximumLag, nil),
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name:      "lag exceeds maximum_lag_on_failover",
+			self:      runningReplica("self", 10000-testMaximumLag-1, nil),
+			leaderLSN: 10000,
+			want:      false,
+		},
+		{
+			name:      "higher priority replica",
+			self:      runningReplica("self", 10000, nil),
+			members:   []dcs.InstanceInfo{runningReplica("other", 9500, dcs.Tags{dcs.TagFailoverPriority: "2"})},
+			leaderLSN: 10000,
+			want:      false,
+		},
+		{
+			name:      "lower priority replica with more WAL",
+			self:      runningReplica("self", 9500, dcs.Tags{dcs.TagFailoverPriority: "2"}),
+			members:   []dcs.InstanceInfo{runningReplica("other", 10000, nil)},
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name:      "higher priority replica lagging too much",
+			self:      runningReplica("self", 10000, nil),
+			members:   []dcs.InstanceInfo{runningReplica("other", 10000-testMaximumLag-1, dcs.Tags{dcs.TagFailoverPriority: "2"})},
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name:      "higher priority replica not running",
+			self:      runningReplica("self", 10000, nil),
+			members:   []dcs.InstanceInfo{stopped},
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name:      "higher priority replica tagged nofailover",
+			self:      runningReplica("self", 9500, nil),
+			members:   []dcs.InstanceInfo{runningReplica("other", 10000, dcs.Tags{dcs.TagFailoverPriority: "2", dcs.TagNoFailover: "true"})},
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name:      "replica with more WAL tagged failover_priority 0",
+			self:      runningReplica("self", 9500, nil),
+			members:   []dcs.InstanceInfo{runningReplica("other", 10000, dcs.Tags{dcs.TagFailoverPriority: "0"})},
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name:      "delayed replica with more WAL",
+			self:      runningReplica("self", 9500, nil),
+			members:   []dcs.InstanceInfo{runningReplica("other", 10000, dcs.Tags{dcs.TagRecoveryMinApplyDelay: "1h"})},
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name:      "equal priority replica with more WAL",
+			self:      runningReplica("self", 9500, nil),
+			members:   []dcs.InstanceInfo{runningReplica("other", 9501, nil)},
+			leaderLSN: 10000,
+			want:      false,
+		},
+		{
+			name:      "equal priority replica with less WAL",
+			self:      runningReplica("self", 9501, nil),
+			members:   []dcs.InstanceInfo{runningReplica("other", 9500, nil)},
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name:      "equal priority replica with the same WAL",
+			self:      runningReplica("self", 9500, nil),
+			members:   []dcs.InstanceInfo{runningReplica("other", 9500, nil)},
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name: "the former leader is not a candidate",
+			self: runningReplica("self", 9500, nil),
+			members: []dcs.InstanceInfo{
+				{ID: "leader", Hostname: "leader", Role: postgresql.Leader, ReceivedLSN: 10000},
+			},
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name: "self is skipped among the members",
+			self: runningReplica("self", 9500, nil),
+			members: []dcs.InstanceInfo{
+				runningReplica("self", 10000, dcs.Tags{dcs.TagFailoverPriority: "2"}),
+				runningReplica("other", 9000, nil),
+			},
+			leaderLSN: 10000,
+			want:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := checkFailoverCandidate(tt.self, tt.members, tt.leaderLSN, testMaximumLag)
+			if got != tt.want {
+				t.Errorf("checkFailoverCandidate = %v (%v), want %v", got, reason, tt.want)
+			}
+			if !got && reason == "" {
+				t.Errorf("checkFailoverCandidate refused without a reason")
+			}
+		})
+	}
+}
+
+func TestCheckSyncCandidate(t *testing.T) {
+	a := runningReplica("a", 0, nil)
+	b := runningReplica("b", 0, nil)
+	c := runningReplica("c", 0, nil)
+	async := runningReplica("async", 0, nil)
+
+	tests := []struct {
+		name      string
+		self      dcs.InstanceInfo
+		members   []dcs.InstanceInfo
+		syncState dcs.SyncState
+		want      bool
+	}{
+		{
+			name:      "synchronous standby",
+			self:      a,
+			members:   []dcs.InstanceInfo{a},
+			syncState: dcs.SyncState{Leader: "leader", Members: []string{"a"}, Quorum: 1},
+			want:      true,
+		},
+		{
+			name:      "asynchronous standby",
+			self:      async,
+			members:   []dcs.InstanceInfo{a, async},
+			syncState: dcs.SyncState{Leader: "leader", Members: []string{"a"}, Quorum: 1},
+			want:      false,
+		},
+		{
+			name:      "no synchronous standby",
+			self:      a,
+			members:   []dcs.InstanceInfo{a},
+			syncState: dcs.SyncState{Leader: "leader", Members: []string{}},
+			want:      false,
+		},
+		{
+			name:      "every standby acknowledges, one is enough",
+			self:      a,
+			members:   []dcs.InstanceInfo{a},
+			syncState: dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 3},
+			want:      true,
+		},
+		{
+			name:      "quorum of 2 out of 3, the other standbys are missing",
+			self:      a,
+			members:   []dcs.InstanceInfo{a},
+			syncState: dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 2},
+			want:      false,
+		},
+		{
+			name:      "quorum of 2 out of 3, 2 standbys available",
+			self:      a,
+			members:   []dcs.InstanceInfo{a, b},
+			syncState: dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 2},
+			want:      true,
+		},
+		{
+			name:      "quorum of 1 out of 3, 2 standbys available",
+			self:      a,
+			members:   []dcs.InstanceInfo{a, b, async},
+			syncState: dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 1},
+			want:      false,
+		},
+		{
+			name:      "quorum of 1 out of 3, every standby available",
+			self:      a,
+			members:   []dcs.InstanceInfo{a, b, c},
+			syncState: dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 1},
+			want:      true,
+		},
+		{
+			name:      "self is not in the members",
+			self:      a,
+			members:   []dcs.InstanceInfo{b},
+			syncState: dcs.SyncState{Leader: "leader", Members: []string{"a", "b"}, Quorum: 1},
+			want:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := checkSyncCandidate(tt.self, tt.members, tt.syncState)
+			if got != tt.want {
+				t.Errorf("checkSyncCandidate = %v (%v), want %v", got, reason, tt.want)
+			}
+			if !got && reason == "" {
+				t.Errorf("checkSyncCandidate refused without a reason")
+			}
+		})
+	}
+}
+
+func TestCheckSwitchoverCandidate(t *testing.T) {
+	leader := runningReplica("leader", 10000, nil)
+	leader.Role = postgresql.Leader
+	leader.State = string(StateRunningLeader)
+
+	starting := runningReplica("starting", 10000, nil)
+	starting.State = string(StateStarting)
+
+	stopped := runningReplica("stopped", 10000, nil)
+	stopped.PostgresState = postgresql.PostgresStateStopped
+
+	tests := []struct {
+		name      string
+		candidate dcs.InstanceInfo
+		leaderLSN postgresql.LSN
+		want      bool
+	}{
+		{
+			name:      "running replica",
+			candidate: runningReplica("a", 10000, nil),
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name:      "lag within maximum_lag_on_failover",
+			candidate: runningReplica("a", 10000-testMaximumLag, nil),
+			leaderLSN: 10000,
+			want:      true,
+		},
+		{
+			name:      "lag exceeds maximum_lag_on_failover",
+			candidate: runningReplica("a", 10000-testMaximumLag-1, nil),
+			leaderLSN: 10000,
+			want:      false,
+		},
+		{
+			name:      "leader",
+			candidate: leader,
+			leaderLSN: 10000,
+			want:      false,
+		},
+		{
+			name:      "tagged nofailover",
+			candidate: runningReplica("a", 10000, dcs.Tags{dcs.TagNoFailover: "true"}),
+			leaderLSN: 10000,
+			want:      false,
+		},
+		{
+			name:      "tagged failover_priority 0",
+			candidate: runningReplica("a", 10000, dcs.Tags{dcs.TagFailoverPriority: "0"}),
+			leaderLSN: 10000,
+			want:      false,
+		},
+		{
+			name:      "delayed replica",
+			candidate: runningReplica("a", 10000, dcs.Tags{dcs.TagRecoveryMinApplyDelay: "30m"}),
+			leaderLSN: 10000,
+			want:      false,
+		},
+		{
+			name:      "replica still starting",
+			candidate: starting,
+			leaderLSN: 10000,
+			want:      false,
+		},
+		{
+			name:      "postgres stopped",
+			candidate: stopped,
+			leaderLSN: 10000,
+			want:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := checkSwitchoverCandidate(tt.candidate, tt.leaderLSN, testMaximumLag)
+			if got != tt.want {
+				t.Errorf("checkSwitchoverCandidate = %v (%v), want %v", got, reason, tt.want)
+			}
+			if !got && reason == "" {
+				t.Errorf("checkSwitchoverCandidate refused without a reason")
+			}
+		})
+	}
+}
+
+// newTestDaemon builds a daemon on top of the in memory dcs, without postgres: only the decisions taken from the dcs
+// content can be exercised
+func newTestDaemon(t *testing.T, store *dcs.MemoryStore, instanceID string, tags dcs.Tags) *Daemon {
+	t.Helper()
+
+	log := logrus.NewEntry(logrus.New())
+	client := dcs.NewMemory(store, dcs.Config{
+		Hostname:    instanceID,
+		InstanceID:  instanceID,
+		Lease:       10,
+		Namespace:   "seeone",
+		ClusterName: "postgresql",
+	}, log)
+	proxy := dcs_proxy.New(client, postgresql.Postmaster{}, tags.NoFailover(), log)
+	if err := proxy.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { proxy.Disconnect() })
+
+	return &Daemon{
+		PgConfig: postgresql.Config{InstanceID: instanceID},
+		DcsProxy: proxy,
+		State:    NewStateMachine(log),
+		Log:      log,
+		Config: Config{
+			Hostname:             instanceID,
+			Tags:                 tags,
+			MaximumLagOnFailover: testMaximumLag,
+			SynchronousMode:      SynchronousModeOff,
+		},
+	}
+}
+
+// waitForNewLeader polls the dcs until an instance other than the former leader holds the leadership
+func waitForNewLeader(t *testing.T, d *Daemon, formerLeader string) string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if role, err := d.DcsProxy.GetRole(context.Background()); err == nil {
+			leader := d.PgConfig.InstanceID
+			if role != postgresql.Leader {
+				leaderInfo, err := d.DcsProxy.GetLeaderInfo(context.Background())
+				if err != nil {
+					t.Fatalf("GetLeaderInfo: %v", err)
+				}
+				leader = leaderInfo.ID
+			}
+
+			if leader != formerLeader {
+				return leader
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("the leadership did not move from %v", formerLeader)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// The leader lease expires: whichever replica wins the election, the leadership ends up on the healthiest candidate
+func TestFailoverOnExpiredLease(t *testing.T) {
+	ctx := context.Background()
+	store := dcs.NewMemoryStore()
+
+	members := map[string]dcs.InstanceInfo{
+		"a": runningReplica("a", 10000, nil),
+		"b": runningReplica("b", 9600, nil),
+		"c": runningReplica("c", 9200, dcs.Tags{dcs.TagFailoverPriority: "2"}),
+		"d": runningReplica("d", 10000, dcs.Tags{dcs.TagNoFailover: "true"}),
+		"e": runningReplica("e", 10000, dcs.Tags{dcs.TagRecoveryMinApplyDelay: "1h"}),
+	}
+	leader := members["a"]
+	leader.Role = postgresql.Leader
+	leader.State = string(StateRunningLeader)
+	members["a"] = leader
+
+	daemons := make(map[string]*Daemon)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		d := newTestDaemon(t, store, id, members[id].Tags)
+		d.lastLeaderLSN = 10000
+		if err := d.DcsProxy.SaveInstanceInfo(ctx, members[id]); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+		daemons[id] = d
+	}
+
+	daemons["a"].DcsProxy.StartElection(ctx)
+	if leaderID := waitForNewLeader(t, daemons["b"], ""); leaderID != "a" {
+		t.Fatalf("expected a to be the leader, got %v", leaderID)
+	}
+	for _, id := range []string{"b", "c", "d", "e"} {
+		daemons[id].DcsProxy.StartElection(ctx)
+	}
+
+	store.ExpireLease("a")
+	formerLeader := "a"
+	for attempt := 0; attempt < len(daemons); attempt++ {
+		leaderID := waitForNewLeader(t, daemons["b"], formerLeader)
+		if leaderID == "d" || leaderID == "e" {
+			t.Fatalf("%v won the election while tagged %v", leaderID, members[leaderID].Tags.NoFailoverTag())
+		}
+
+		isAllowed, reason, err := daemons[leaderID].isFailoverAllowed(ctx, members[leaderID])
+		if err != nil {
+			t.Fatalf("isFailoverAllowed: %v", err)
+		}
+
+		if isAllowed {
+			if leaderID != "c" {
+				t.Fatalf("%v promoted instead of c", leaderID)
+			}
+			return
+		}
+
+		t.Logf("%v refused the promotion: %v", leaderID, reason)
+		if err := daemons[leaderID].yieldLeadership(ctx); err != nil {
+			t.Fatalf("yieldLeadership: %v", err)
+		}
+		formerLeader = leaderID
+	}
+
+	t.Fatalf("no member promoted")
+}
+
+func TestGetManualFailover(t *testing.T) {
+	scheduledAt := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		failover *dcs.Failover
+		want     bool
+	}{
+		{name: "none"},
+		{name: "failover to the instance", failover: &dcs.Failover{Candidate: "b"}, want: true},
+		{name: "failover to another instance", failover: &dcs.Failover{Candidate: "c"}, want: true},
+		{name: "switchover not handed over yet", failover: &dcs.Failover{Leader: "a", Candidate: "b"}},
+		{name: "scheduled switchover", failover: &dcs.Failover{Candidate: "b", ScheduledAt: &scheduledAt}},
+		{name: "switchover handed over to the instance", failover: &dcs.Failover{Leader: "a", Candidate: "b", HandedOver: true}, want: true},
+		{name: "switchover handed over to another instance", failover: &dcs.Failover{Leader: "a", Candidate: "c", HandedOver: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			d := newTestDaemon(t, dcs.NewMemoryStore(), "b", nil)
+			if tt.failover != nil {
+				if err := d.DcsProxy.SaveFailover(ctx, *tt.failover); err != nil {
+					t.Fatalf("SaveFailover: %v", err)
+				}
+			}
+
+			got, err := d.getManualFailover(ctx)
+			if err != nil {
+				t.Fatalf("getManualFailover: %v", err)
+			}
+			if (got != nil) != tt.want {
+				t.Errorf("getManualFailover = %+v, want a failover: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The switchover target holds the leadership before it is promoted: a replica with a higher priority must not make it
+// yield, the former leader is already stopped
+func TestHandedOverCandidateIgnoresPriority(t *testing.T) {
+	ctx := context.Background()
+	store := dcs.NewMemoryStore()
+
+	members := map[string]dcs.InstanceInfo{
+		"a": {ID: "a", Hostname: "a", Role: postgresql.Leader, PostgresState: postgresql.PostgresStateStopped, ReceivedLSN: 10000},
+		"b": runningReplica("b", 10000, nil),
+		"c": runningReplica("c", 10000, dcs.Tags{dcs.TagFailoverPriority: "2"}),
+	}
+	daemons := make(map[string]*Daemon)
+	for _, id := range []string{"a", "b", "c"} {
+		d := newTestDaemon(t, store, id, members[id].Tags)
+		d.lastLeaderLSN = 10000
+		if err := d.DcsProxy.SaveInstanceInfo(ctx, members[id]); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+		daemons[id] = d
+	}
+	b := daemons["b"]
+
+	if isAllowed, _, err := b.isFailoverAllowed(ctx, members["b"]); err != nil || isAllowed {
+		t.Fatalf("expected the automatic failover checks to prefer c, got %v (%v)", isAllowed, err)
+	}
+
+	handOver := dcs.Failover{Leader: "a", Candidate: "b", HandedOver: true}
+	if err := daemons["a"].DcsProxy.SaveFailover(ctx, handOver); err != nil {
+		t.Fatalf("SaveFailover: %v", err)
+	}
+
+	// The candidate consumes the key when it promotes, not as a switchover request
+	if b.runSwitchover(ctx) {
+		t.Fatalf("the handover was run as a switchover")
+	}
+	if failover, err := b.getManualFailover(ctx); err != nil || failover == nil {
+		t.Fatalf("expected b to find the handover, got %v (%v)", failover, err)
+	}
+
+	isAllowed, reason, err := b.isManualFailoverAllowed(ctx, members["b"])
+	if err != nil {
+		t.Fatalf("isManualFailoverAllowed: %v", err)
+	}
+	if !isAllowed {
+		t.Fatalf("b refused the handover: %v", reason)
+	}
+}
+
+func TestRunSwitchoverDiscardsStaleHandover(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDaemon(t, dcs.NewMemoryStore(), "a", nil)
+
+	if err := d.DcsProxy.SaveFailover(ctx, dcs.Failover{Leader: "a", Candidate: "b", HandedOver: true}); err != nil {
+		t.Fatalf("SaveFailover: %v", err)
+	}
+
+	// a holds the leadership again, b never took it: the handover must not be run a second time
+	if d.runSwitchover(ctx) {
+		t.Fatalf("the handover was run again")
+	}
+	if failover, err := d.DcsProxy.GetFailover(ctx); err != nil || failover != nil {
+		t.Fatalf("expected the stale handover to be removed, got %+v (%v)", failover, err)
+	}
+}
@@ -0,0 +1,188 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"sync"
+	"time"
+)
+
+var ErrRestartAlreadyScheduled = fmt.Errorf("a restart is already scheduled")
+
+type RestartRequest struct {
+	// PendingRestartOnly skips the restart if no parameter is pending restart
+	PendingRestartOnly bool `json:"pending_restart_only"`
+	// ScheduledAt delays the restart, it is executed at the first cycle after it
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+	// Role skips the restart if the instance role is not the given one when the restart is due
+	Role string `json:"role,omitempty"`
+}
+
+func (r RestartRequest) Validate() error {
+	if r.Role != "" && r.Role != postgresql.Leader && r.Role != postgresql.Replica {
+		return fmt.Errorf("role must be either %v or %v, got %q", postgresql.Leader, postgresql.Replica, r.Role)
+	}
+
+	return nil
+}
+
+type RestartOutcome string
+
+const (
+	RestartOutcomeDone       RestartOutcome = "done"
+	RestartOutcomeNotPending RestartOutcome = "not-pending" // pending restart only, and no parameter was pending restart
+	RestartOutcomeSkipped    RestartOutcome = "skipped"     // the conditions of the request were not met, or it was cancelled
+	RestartOutcomeFailed     RestartOutcome = "failed"
+)
+
+// RestartResult is the outcome of the last restart request, it is reset when a new one is scheduled
+type RestartResult struct {
+	Outcome    RestartOutcome `json:"outcome"`
+	Reason     string         `json:"reason,omitempty"`
+	FinishedAt time.Time      `json:"finished_at"`
+}
+
+type RestartStatus struct {
+	Scheduled  *RestartRequest `json:"scheduled"`
+	InProgress bool            `json:"in_progress"`
+	Last       *RestartResult  `json:"last"`
+}
+
+// RestartScheduler is shared between the api, which schedules restarts, and the daemon, which executes them during its
+// cycle so that a restart never races with the other daemon actions
+type RestartScheduler struct {
+	mu         sync.Mutex
+	scheduled  *RestartRequest
+	inProgress bool
+	last       *RestartResult
+}
+
+func NewRestartScheduler() *RestartScheduler {
+	return &RestartScheduler{}
+}
+
+func (r *RestartScheduler) Schedule(request RestartRequest) error {
+	if err := request.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.scheduled != nil || r.inProgress {
+		return ErrRestartAlreadyScheduled
+	}
+
+	r.scheduled = &request
+	r.last = nil
+	return nil
+}
+
+// Cancel removes the scheduled restart, a restart already in progress cannot be cancelled
+func (r *RestartScheduler) Cancel() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.scheduled == nil {
+		return false
+	}
+
+	r.scheduled = nil
+	r.last = &RestartResult{Outcome: RestartOutcomeSkipped, Reason: "cancelled", FinishedAt: time.Now()}
+	return true
+}
+
+func (r *RestartScheduler) Status() RestartStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return RestartStatus{Scheduled: r.scheduled, InProgress: r.inProgress, Last: r.last}
+}
+
+// begin takes the scheduled restart if it is due, finish must be called once it is done
+func (r *RestartScheduler) begin(now time.Time) (RestartRequest, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.scheduled == nil || (r.scheduled.ScheduledAt != nil && now.Before(*r.scheduled.ScheduledAt)) {
+		return RestartRequest{}, false
+	}
+
+	request := *r.scheduled
+	r.scheduled = nil
+	r.inProgress = true
+	return request, true
+}
+
+// finish records the outcome of the restart taken by begin
+func (r *RestartScheduler) finish(outcome RestartOutcome, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.inProgress = false
+	r.last = &RestartResult{Outcome: outcome, Reason: reason, FinishedAt: time.Now()}
+}
+
+// runScheduledRestart restarts postgres if a restart is due and its conditions are met, otherwise the restart is
+// discarded. The outcome is exposed in the restart status, so that the rolling restart can tell a skipped or failed
+// restart from a successful one
+func (d *Daemon) runScheduledRestart(ctx context.Context, role string) error {
+	request, ok := d.Restarts.begin(time.Now())
+	if !ok {
+		return nil
+	}
+
+	outcome, reason, err := d.restart(ctx, request, role)
+	if err != nil {
+		d.Restarts.finish(RestartOutcomeFailed, err.Error())
+		return err
+	}
+
+	switch outcome {
+	case RestartOutcomeSkipped:
+		d.Log.Warningf("restart skipped: %v", reason)
+	case RestartOutcomeNotPending:
+		d.Log.Infof("restart skipped: %v", reason)
+	}
+	d.Restarts.finish(outcome, reason)
+	return nil
+}
+
+func (d *Daemon) restart(ctx context.Context, request RestartRequest, role string) (RestartOutcome, string, error) {
+	if request.Role != "" && request.Role != role {
+		return RestartOutcomeSkipped, fmt.Sprintf("it was requested for the %v, but the instance is the %v", request.Role, role), nil
+	}
+
+	state := d.State.Current()
+	if state != StateRunningLeader && state != StateRunningReplica {
+		return RestartOutcomeSkipped, fmt.Sprintf("postgres is not running, the instance is %v", state), nil
+	}
+
+	if request.PendingRestartOnly {
+		pendingRestart, err := d.Postmaster.GetPendingRestart(ctx)
+		if err != nil {
+			return "", "", fmt.Errorf("could not get parameters pending restart: %v", err)
+		}
+
+		if len(pendingRestart) == 0 {
+			return RestartOutcomeNotPending, "no parameter is pending restart", nil
+		}
+	}
+
+	d.setState(StateStarting, "restart requested")
+	if err := d.Postmaster.Stop(postgresql.StopModeFast); err != nil {
+		return "", "", fmt.Errorf("could not stop postgres: %v", err)
+	}
+
+	if err := d.Postmaster.Start(); err != nil {
+		return "", "", fmt.Errorf("could not Start postgres process: %v", err)
+	}
+
+	if err := d.Postmaster.WaitForStart(); err != nil {
+		return "", "", err
+	}
+
+	d.setState(state, "postgres restarted")
+	return RestartOutcomeDone, "", nil
+}
@@ -0,0 +1,44 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartSchedulerLastResult(t *testing.T) {
+	r := NewRestartScheduler()
+
+	if err := r.Schedule(RestartRequest{}); err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+	if _, ok := r.begin(time.Now()); !ok {
+		t.Fatalf("the restart was not due")
+	}
+	if status := r.Status(); !status.InProgress || status.Last != nil {
+		t.Fatalf("unexpected status during the restart %+v", status)
+	}
+
+	r.finish(RestartOutcomeFailed, "could not stop postgres")
+	status := r.Status()
+	if status.InProgress || status.Last == nil || status.Last.Outcome != RestartOutcomeFailed {
+		t.Fatalf("unexpected status after the restart %+v", status)
+	}
+
+	// A new request must not be reported with the result of the previous one
+	if err := r.Schedule(RestartRequest{}); err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+	if status := r.Status(); status.Last != nil {
+		t.Fatalf("the previous result was kept: %+v", status.Last)
+	}
+
+	if !r.Cancel() {
+		t.Fatalf("the scheduled restart was not cancelled")
+	}
+	if status := r.Status(); status.Last == nil || status.Last.Outcome != RestartOutcomeSkipped {
+		t.Fatalf("unexpected status after the cancellation %+v", status)
+	}
+	if r.Cancel() {
+		t.Fatalf("cancelled a restart which is not scheduled")
+	}
+}
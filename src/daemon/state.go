@@ -0,0 +1,166 @@
+package daemon
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// State is the lifecycle state of the node, it replaces the diagram in docs/daemon-loop as the specification of what
+// the daemon is allowed to do
+type State string
+
+const (
+	StateBootstrapping  State = "bootstrapping"   // initdb for a leader, base backup for a replica with empty data directory
+	StateStarting       State = "starting"        // the postgres process was started and is not yet observed running
+	StateRunningLeader  State = "running-leader"  // postgres is running and accepting writes
+	StateRunningReplica State = "running-replica" // postgres is running in recovery mode
+	StatePromoting      State = "promoting"       // a replica is being promoted to leader
+	StateDemoting       State = "demoting"        // postgres is running as leader, but the instance lost the leadership
+	StateRewinding      State = "rewinding"       // a former leader is being re-synchronized with pg_rewind
+	StateReinitializing State = "reinitializing"  // the data directory is discarded and cloned again from the leader
+	StateStopped        State = "stopped"         // postgres is not running and the daemon did not act yet
+	StateError          State = "error"           // the last daemon cycle failed
+)
+
+var ErrInvalidTransition = fmt.Errorf("invalid state transition")
+
+// transitions lists, for every state, the states that can follow it. Stopped and Error can be reached from any state:
+// postgres can be stopped from the api and every cycle can fail
+var transitions = map[State][]State{
+	StateStopped: {
+		StateBootstrapping,
+		StateStarting,
+		StateRunningLeader,
+		StateRunningReplica,
+		StatePromoting,
+		StateDemoting,
+		StateRewinding,
+		StateReinitializing,
+	},
+	StateBootstrapping: {StateStarting},
+	StateStarting: {
+		StateRunningLeader,
+		StateRunningReplica,
+		StatePromoting,
+		StateDemoting,
+		StateRewinding,
+		StateReinitializing,
+	},
+	StateRunningLeader: {
+		StateDemoting,
+		StateStarting,
+		StateRewinding,
+		StateReinitializing,
+	},
+	StateRunningReplica: {
+		StatePromoting,
+		StateRunningLeader,
+		StateStarting,
+		StateRewinding,
+		StateReinitializing,
+	},
+	StatePromoting: {
+		StateRunningLeader,
+		StateRunningReplica,
+	},
+	StateDemoting: {
+		StateRewinding,
+		StateReinitializing,
+		StateStarting,
+	},
+	StateRewinding: {
+		StateStarting,
+		StateReinitializing,
+	},
+	StateReinitializing: {StateStarting},
+	StateError: {
+		StateBootstrapping,
+		StateStarting,
+		StateRunningLeader,
+		StateRunningReplica,
+		StatePromoting,
+		StateDemoting,
+		StateRewinding,
+		StateReinitializing,
+	},
+}
+
+// CanTransition reports if the state machine can move from one state to the other, staying in the same state is
+// always allowed
+func CanTransition(from, to State) bool {
+	if from == to || to == StateStopped || to == StateError {
+		return true
+	}
+
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+type StateStatus struct {
+	State    State     `json:"state"`
+	Previous State     `json:"previous"`
+	Reason   string    `json:"reason"`
+	Since    time.Time `json:"since"`
+}
+
+// StateMachine is shared between the daemon, which drives it, and the api, which exposes it
+type StateMachine struct {
+	mu     sync.RWMutex
+	status StateStatus
+	log    *logrus.Entry
+}
+
+func NewStateMachine(log *logrus.Entry) *StateMachine {
+	return &StateMachine{
+		status: StateStatus{
+			State:  StateStopped,
+			Reason: "seeone started",
+			Since:  time.Now(),
+		},
+		log: log,
+	}
+}
+
+func (s *StateMachine) Current() State {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status.State
+}
+
+func (s *StateMachine) Status() StateStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+// Transition moves the state machine to the given state, every actual change is logged along with its reason
+func (s *StateMachine) Transition(to State, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from := s.status.State
+	if !CanTransition(from, to) {
+		return fmt.Errorf("%w from %v to %v: %v", ErrInvalidTransition, from, to, reason)
+	}
+
+	if from == to {
+		return nil
+	}
+
+	s.log.WithField("from", from).WithField("to", to).Infof("state transition: %v", reason)
+	s.status = StateStatus{
+		State:    to,
+		Previous: from,
+		Reason:   reason,
+		Since:    time.Now(),
+	}
+
+	return nil
+}
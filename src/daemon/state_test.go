@@ -0,0 +1,107 @@
+package daemon
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		name string
+		from State
+		to   State
+		want bool
+	}{
+		{name: "same state", from: StateRunningLeader, to: StateRunningLeader, want: true},
+		{name: "any state can stop", from: StatePromoting, to: StateStopped, want: true},
+		{name: "any state can fail", from: StateBootstrapping, to: StateError, want: true},
+		{name: "bootstrap an empty data directory", from: StateStopped, to: StateBootstrapping, want: true},
+		{name: "start after the bootstrap", from: StateBootstrapping, to: StateStarting, want: true},
+		{name: "run before starting", from: StateBootstrapping, to: StateRunningLeader, want: false},
+		{name: "run as leader once started", from: StateStarting, to: StateRunningLeader, want: true},
+		{name: "run as replica once started", from: StateStarting, to: StateRunningReplica, want: true},
+		{name: "bootstrap a started instance", from: StateStarting, to: StateBootstrapping, want: false},
+		{name: "leader loses the leadership", from: StateRunningLeader, to: StateDemoting, want: true},
+		{name: "leader becomes replica without demoting", from: StateRunningLeader, to: StateRunningReplica, want: false},
+		{name: "leader promoted again", from: StateRunningLeader, to: StatePromoting, want: false},
+		{name: "demoted leader restarts as replica", from: StateDemoting, to: StateStarting, want: true},
+		{name: "demoted leader rewinds", from: StateDemoting, to: StateRewinding, want: true},
+		{name: "demoted leader runs as replica without restarting", from: StateDemoting, to: StateRunningReplica, want: false},
+		{name: "demoted leader keeps leading", from: StateDemoting, to: StateRunningLeader, want: false},
+		{name: "replica promoted", from: StateRunningReplica, to: StatePromoting, want: true},
+		{name: "replica demoted", from: StateRunningReplica, to: StateDemoting, want: false},
+		{name: "promotion succeeds", from: StatePromoting, to: StateRunningLeader, want: true},
+		{name: "promotion falls back to replica", from: StatePromoting, to: StateRunningReplica, want: true},
+		{name: "promotion restarts postgres", from: StatePromoting, to: StateStarting, want: false},
+		{name: "rewind restarts postgres", from: StateRewinding, to: StateStarting, want: true},
+		{name: "failed rewind reinitializes", from: StateRewinding, to: StateReinitializing, want: true},
+		{name: "rewind runs as replica without restarting", from: StateRewinding, to: StateRunningReplica, want: false},
+		{name: "reinitialize restarts postgres", from: StateReinitializing, to: StateStarting, want: true},
+		{name: "reinitialize runs as leader", from: StateReinitializing, to: StateRunningLeader, want: false},
+		{name: "recover from an error", from: StateError, to: StateRunningReplica, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanTransition(tt.from, tt.to); got != tt.want {
+				t.Errorf("CanTransition(%v, %v) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeaderBecomesReplicaThroughDemoting(t *testing.T) {
+	s := NewStateMachine(logrus.NewEntry(logrus.New()))
+	for _, to := range []State{StateStarting, StateRunningLeader} {
+		if err := s.Transition(to, "leader"); err != nil {
+			t.Fatalf("Transition: %v", err)
+		}
+	}
+
+	if err := s.Transition(StateRunningReplica, "lost the leadership"); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("expected ErrInvalidTransition, got %v", err)
+	}
+
+	for _, to := range []State{StateDemoting, StateStarting, StateRunningReplica} {
+		if err := s.Transition(to, "lost the leadership"); err != nil {
+			t.Fatalf("Transition: %v", err)
+		}
+	}
+}
+
+func TestStateMachineTransition(t *testing.T) {
+	s := NewStateMachine(logrus.NewEntry(logrus.New()))
+	if s.Current() != StateStopped {
+		t.Fatalf("expected the initial state to be %v, got %v", StateStopped, s.Current())
+	}
+
+	if err := s.Transition(StateBootstrapping, "empty data directory"); err != nil {
+		t.Fatalf("Transition: %v", err)
+	}
+
+	err := s.Transition(StateRunningLeader, "skipping the start")
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("expected ErrInvalidTransition, got %v", err)
+	}
+	if s.Current() != StateBootstrapping {
+		t.Fatalf("an invalid transition changed the state to %v", s.Current())
+	}
+
+	if err := s.Transition(StateStarting, "initdb done"); err != nil {
+		t.Fatalf("Transition: %v", err)
+	}
+	status := s.Status()
+	if status.State != StateStarting || status.Previous != StateBootstrapping || status.Reason != "initdb done" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	// Staying in the same state keeps the original reason and time
+	if err := s.Transition(StateStarting, "still starting"); err != nil {
+		t.Fatalf("Transition: %v", err)
+	}
+	if s.Status() != status {
+		t.Fatalf("a transition to the same state changed the status to %+v", s.Status())
+	}
+}
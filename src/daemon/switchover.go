@@ -0,0 +1,275 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+const (
+	// switchoverTimeout bounds the wait for the candidate to receive the shutdown checkpoint of the leader
+	switchoverTimeout      = 60 * time.Second
+	switchoverPollInterval = time.Second
+)
+
+// runSwitchover executes the switchover stored in the dcs, if it is addressed to this leader and due. It returns true
+// once the leadership was handed over: postgres is stopped and the next cycle rejoins the cluster as replica
+func (d *Daemon) runSwitchover(ctx context.Context) bool {
+	failover, err := d.DcsProxy.GetFailover(ctx)
+	if err != nil {
+		d.Log.Warningf("could not get the requested failover: %v", err)
+		return false
+	}
+
+	if failover == nil {
+		return false
+	}
+
+	if failover.HandedOver {
+		// The candidate removes the key once it is promoted, any other leader finds a handover that did not happen
+		if failover.Candidate != d.PgConfig.InstanceID {
+			d.Log.Warningf("discarding the handover to %v, the instance holds the leadership", failover.Candidate)
+			if err := d.DcsProxy.DeleteFailover(ctx); err != nil {
+				d.Log.Errorf("could not delete the requested failover: %v", err)
+			}
+		}
+
+		return false
+	}
+
+	if !failover.IsDue(time.Now()) {
+		d.Log.Debugf("switchover to %v scheduled at %v", failover.Candidate, failover.ScheduledAt)
+		return false
+	}
+
+	// The request is consumed whatever the outcome, a failed switchover must not be attempted again at every cycle. Once
+	// the leadership is handed over the key is left to the candidate
+	handedOver := false
+	defer func() {
+		if handedOver {
+			return
+		}
+
+		if err := d.DcsProxy.DeleteFailover(ctx); err != nil {
+			d.Log.Errorf("could not delete the requested failover: %v", err)
+		}
+	}()
+
+	// A failover found by a running leader is executed as a switchover, the leader is up after all
+	if failover.Leader != "" && failover.Leader != d.PgConfig.InstanceID {
+		d.Log.Warningf("discarding switchover addressed to former leader %v", failover.Leader)
+		return false
+	}
+
+	if failover.Candidate == d.PgConfig.InstanceID {
+		d.Log.Warningf("discarding failover to the current leader")
+		return false
+	}
+
+	if d.State.Current() != StateRunningLeader {
+		d.Log.Warningf("discarding switchover to %v, postgres is not running as leader", failover.Candidate)
+		return false
+	}
+
+	if err := d.switchover(ctx, failover.Candidate); err != nil {
+		d.Log.Errorf("switchover to %v failed: %v", failover.Candidate, err)
+		return false
+	}
+
+	handedOver = true
+	return true
+}
+
+// switchover hands over the leadership to the candidate without losing any transaction: postgres is stopped cleanly,
+// and the leadership is moved in the dcs only once the candidate received the shutdown checkpoint. Any failure after
+// the stop starts postgres again as leader
+func (d *Daemon) switchover(ctx context.Context, candidateID string) error {
+	candidate, err := d.getMember(ctx, candidateID)
+	if err != nil {
+		return err
+	}
+
+	candidateConn, err := d.Postmaster.ConnectTo(ctx, candidate.Hostname)
+	if err != nil {
+		return fmt.Errorf("could not connect to %v: %v", candidate.Hostname, err)
+	}
+	defer candidateConn.Close(ctx)
+
+	// The published WAL positions are as old as the last cycle, both are read again
+	if candidate.ReceivedLSN, err = d.Postmaster.GetReceivedLSN(ctx, candidateConn); err != nil {
+		return fmt.Errorf("could not get WAL position of %v: %v", candidate.Hostname, err)
+	}
+
+	leaderLSN, _, err := d.Postmaster.GetWALPositions(ctx)
+	if err != nil {
+		return err
+	}
+
+	if isAllowed, reason := checkSwitchoverCandidate(candidate, leaderLSN, d.MaximumLagOnFailover); !isAllowed {
+		return fmt.Errorf("%v", reason)
+	}
+
+	if d.SynchronousMode != SynchronousModeOff {
+		syncState, err := d.DcsProxy.GetSyncState(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !syncState.IsMember(candidate.Hostname) {
+			return fmt.Errorf("%v is not a synchronous standby", candidate.Hostname)
+		}
+	}
+
+	// The shutdown checkpoint only has to flush what was written after this one, keeping the downtime short
+	d.Log.Infof("switchover to %v: checkpoint", candidate.Hostname)
+	if err := d.Postmaster.Checkpoint(ctx); err != nil {
+		return fmt.Errorf("could not checkpoint: %v", err)
+	}
+
+	d.setState(StateDemoting, fmt.Sprintf("switchover to %v", candidate.Hostname))
+	if err := d.Postmaster.Stop(postgresql.StopModeFast); err != nil {
+		return d.abortSwitchover(fmt.Errorf("could not stop postgres: %v", err))
+	}
+
+	controlData, err := d.Postmaster.ControlData()
+	if err != nil {
+		return d.abortSwitchover(err)
+	}
+
+	shutdownCheckpoint, err := controlData.CheckpointLSN()
+	if err != nil {
+		return d.abortSwitchover(err)
+	}
+
+	if err := d.waitForShutdownCheckpoint(ctx, candidateConn, shutdownCheckpoint); err != nil {
+		return d.abortSwitchover(fmt.Errorf("%v did not receive the shutdown checkpoint: %v", candidate.Hostname, err))
+	}
+
+	// Published before the handover, so that the candidate does not take this instance for an orphan leader
+	if err := d.DcsProxy.SaveInstanceInfo(ctx, d.getInstanceInfo(ctx, postgresql.Leader)); err != nil {
+		return d.abortSwitchover(fmt.Errorf("could not publish the stopped leader: %v", err))
+	}
+
+	// The candidate must not compare itself with the other members once it holds the leadership: a replica with a
+	// higher failover priority would make it yield, after this instance stopped
+	handOver := dcs.Failover{Leader: d.PgConfig.InstanceID, Candidate: candidate.ID, HandedOver: true}
+	if err := d.DcsProxy.SaveFailover(ctx, handOver); err != nil {
+		return d.abortSwitchover(fmt.Errorf("could not record the handover: %v", err))
+	}
+
+	if err := d.DcsProxy.Promote(ctx, candidate.ID); err != nil {
+		return d.abortSwitchover(fmt.Errorf("could not hand over the leadership: %v", err))
+	}
+
+	d.Log.Infof("switchover: leadership handed over to %v", candidate.Hostname)
+	// Join the election queue again, some dcs dropped this instance from it during the handover
+	d.DcsProxy.StartElection(ctx)
+	return nil
+}
+
+// waitForShutdownCheckpoint waits until the candidate received the WAL past the shutdown checkpoint record
+func (d *Daemon) waitForShutdownCheckpoint(ctx context.Context, candidateConn *pgx.Conn, checkpoint postgresql.LSN) error {
+	timeout, cancel := context.WithTimeout(ctx, switchoverTimeout)
+	defer cancel()
+
+	for {
+		received, err := d.Postmaster.GetReceivedLSN(timeout, candidateConn)
+		if err != nil {
+			return err
+		}
+
+		d.Log.Debugf("switchover: candidate received %v, shutdown checkpoint at %v", received, checkpoint)
+		if received > checkpoint {
+			return nil
+		}
+
+		select {
+		case <-time.After(switchoverPollInterval):
+		case <-timeout.Done():
+			return fmt.Errorf("timed out at %v", received)
+		}
+	}
+}
+
+// abortSwitchover starts postgres again as leader, the instance still holds the leadership
+func (d *Daemon) abortSwitchover(cause error) error {
+	d.setState(StateStarting, fmt.Sprintf("switchover aborted: %v", cause))
+	if !d.Postmaster.IsRunning() {
+		if err := d.Postmaster.Start(); err != nil {
+			return fmt.Errorf("%v, and postgres could not be started again: %v", cause, err)
+		}
+
+		if err := d.Postmaster.WaitForStart(); err != nil {
+			return fmt.Errorf("%v, and postgres could not be started again: %v", cause, err)
+		}
+	}
+
+	d.setState(StateRunningLeader, "switchover aborted")
+	return cause
+}
+
+func (d *Daemon) getMember(ctx context.Context, instanceID string) (dcs.InstanceInfo, error) {
+	instances, err := d.DcsProxy.GetClusterInstances(ctx)
+	if err != nil {
+		return dcs.InstanceInfo{}, err
+	}
+
+	for _, instance := range instances {
+		if instance.ID == instanceID {
+			return instance, nil
+		}
+	}
+
+	return dcs.InstanceInfo{}, fmt.Errorf("instance %v is not a member of the cluster", instanceID)
+}
+
+// getManualFailover returns the failover requested while the leader is down, if any: it is read by the instance that
+// won the election before promoting. A switchover handed over to the instance is returned too, the former leader
+// already checked the candidate
+func (d *Daemon) getManualFailover(ctx context.Context) (*dcs.Failover, error) {
+	failover, err := d.DcsProxy.GetFailover(ctx)
+	if err != nil || failover == nil {
+		return nil, err
+	}
+
+	if failover.HandedOver && failover.Candidate == d.PgConfig.InstanceID {
+		return failover, nil
+	}
+
+	if failover.IsSwitchover() {
+		return nil, nil
+	}
+
+	return failover, nil
+}
+
+// handOverManualFailover gives the leadership won in the election to the failover candidate. It returns false if the
+// candidate cannot take it, the request is then discarded and the automatic failover goes on
+func (d *Daemon) handOverManualFailover(ctx context.Context, failover *dcs.Failover) bool {
+	candidate, err := d.getMember(ctx, failover.Candidate)
+	if err == nil {
+		if isAllowed, reason := checkSwitchoverCandidate(candidate, d.lastLeaderLSN, d.MaximumLagOnFailover); !isAllowed {
+			err = fmt.Errorf("%v", reason)
+		}
+	}
+
+	if err == nil {
+		err = d.DcsProxy.Promote(ctx, candidate.ID)
+	}
+
+	if err != nil {
+		d.Log.Errorf("discarding failover to %v: %v", failover.Candidate, err)
+		if err := d.DcsProxy.DeleteFailover(ctx); err != nil {
+			d.Log.Errorf("could not delete the requested failover: %v", err)
+		}
+
+		return false
+	}
+
+	d.Log.Infof("failover: leadership handed over to %v", candidate.Hostname)
+	d.DcsProxy.StartElection(ctx)
+	return true
+}
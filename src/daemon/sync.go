@@ -0,0 +1,204 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"sort"
+)
+
+const (
+	SynchronousModeOff = "off"
+	// SynchronousModeOn makes commits wait for the first synchronous node count standbys: FIRST n (...)
+	SynchronousModeOn = "on"
+	// SynchronousModeQuorum makes commits wait for any synchronous node count standbys: ANY n (...)
+	SynchronousModeQuorum = "quorum"
+
+	// noSynchronousStandby is used in strict mode when no standby qualifies: spaces and colons are not allowed in
+	// hostnames, no standby connects with this application_name and commits wait until a qualifying standby is picked.
+	// A wildcard would let nofailover and delayed replicas acknowledge them
+	noSynchronousStandby = "seeone: no synchronous standby"
+)
+
+// manageSynchronousReplication runs on the leader at every cycle. The sync state in the dcs must cover every commit
+// postgres acknowledged: before postgres waits for new standbys the sync state is widened to cover both the current and
+// the new synchronous_standby_names, it is narrowed down to the new standbys only once postgres applied them
+func (d *Daemon) manageSynchronousReplication(ctx context.Context) error {
+	currentNames, err := d.Postmaster.GetSynchronousStandbyNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	if d.SynchronousMode == SynchronousModeOff {
+		if currentNames != "" {
+			d.Log.Infof("synchronous mode is off, resetting synchronous_standby_names")
+			return d.Postmaster.SetSynchronousStandbyNames(ctx, "")
+		}
+
+		return nil
+	}
+
+	stats, err := d.Postmaster.GetReplicationStats(ctx)
+	if err != nil {
+		return err
+	}
+
+	instances, err := d.DcsProxy.GetClusterInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	syncState, err := d.DcsProxy.GetSyncState(ctx)
+	if err != nil {
+		return err
+	}
+
+	quorum := d.SynchronousMode == SynchronousModeQuorum
+	standbys := pickSynchronousStandbys(stats, instances, syncState, d.SynchronousNodeCount, quorum)
+
+	target := buildSyncState(d.Hostname, standbys, d.SynchronousNodeCount, quorum, d.SynchronousModeStrict)
+
+	names := buildSynchronousStandbyNames(standbys, d.SynchronousNodeCount, quorum, d.SynchronousModeStrict)
+	if len(standbys) == 0 && d.SynchronousModeStrict {
+		d.Log.Warningf("no synchronous standby available, commits are blocked until one connects")
+	}
+
+	if names == currentNames {
+		// postgres waits for the target standbys only, the standbys it no longer waits for can be removed
+		return d.saveSyncState(ctx, syncState, target)
+	}
+
+	if err := d.saveSyncState(ctx, syncState, widenSyncState(syncState, target)); err != nil {
+		return err
+	}
+
+	d.Log.Infof("setting synchronous_standby_names to %q", names)
+	return d.Postmaster.SetSynchronousStandbyNames(ctx, names)
+}
+
+func (d *Daemon) saveSyncState(ctx context.Context, current, next dcs.SyncState) error {
+	if isSameSyncState(current, next) {
+		return nil
+	}
+
+	d.Log.Infof("synchronous standbys: %v, quorum: %v", next.Members, next.Quorum)
+	if err := d.DcsProxy.SaveSyncState(ctx, next); err != nil {
+		return fmt.Errorf("could not save sync state: %v", err)
+	}
+
+	return nil
+}
+
+// buildSyncState returns the sync state matching synchronous_standby_names built from the same standbys: in quorum
+// mode a commit waits for count of them, otherwise for all of them as the list is already cut to count
+func buildSyncState(leader string, standbys []string, count int, quorum bool, strict bool) dcs.SyncState {
+	members := append([]string{}, standbys...)
+	sort.Strings(members)
+
+	syncState := dcs.SyncState{
+		Leader:  leader,
+		Members: members,
+		Quorum:  len(members),
+		Strict:  strict,
+	}
+	if quorum && count < len(members) {
+		syncState.Quorum = count
+	}
+
+	return syncState
+}
+
+// widenSyncState returns the sync state covering the commits acknowledged both with the current and with the target
+// synchronous_standby_names: the union of the members, with the smaller quorum. Dropping to asynchronous replication
+// does not need a wider state, those commits are not covered anyway
+func widenSyncState(current, target dcs.SyncState) dcs.SyncState {
+	if len(current.Members) == 0 || current.Leader != target.Leader {
+		return target
+	}
+
+	if len(target.Members) == 0 {
+		current.Strict = target.Strict
+		return current
+	}
+
+	members := append([]string{}, current.Members...)
+	for _, member := range target.Members {
+		if !contains(members, member) {
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+
+	widened := target
+	widened.Members = members
+	if current.Quorum < widened.Quorum {
+		widened.Quorum = current.Quorum
+	}
+
+	return widened
+}
+
+// pickSynchronousStandbys chooses among the streaming replicas which are cluster members and can be promoted: in quorum
+// mode all of them, otherwise the first count, keeping the current synchronous standbys first to avoid swapping them at
+// every cycle
+func pickSynchronousStandbys(stats []postgresql.ReplicationStat, instances []dcs.InstanceInfo, syncState dcs.SyncState, count int, quorum bool) []string {
+	members := make(map[string]bool)
+	for _, instance := range instances {
+		if instance.Role == postgresql.Replica && !instance.Tags.NoFailover() {
+			members[instance.Hostname] = true
+		}
+	}
+
+	standbys := make([]string, 0)
+	for _, stat := range stats {
+		if members[stat.ApplicationName] {
+			standbys = append(standbys, stat.ApplicationName)
+		}
+	}
+
+	// stats are sorted by flush position, the stable sort keeps that order within the two groups
+	sort.SliceStable(standbys, func(i, j int) bool {
+		return syncState.IsMember(standbys[i]) && !syncState.IsMember(standbys[j])
+	})
+
+	if !quorum && len(standbys) > count {
+		standbys = standbys[:count]
+	}
+
+	return standbys
+}
+
+// buildSynchronousStandbyNames returns synchronous_standby_names for the given standbys. Without standbys, falling back to
+// asynchronous replication could lose commits on failover: strict mode blocks them instead
+func buildSynchronousStandbyNames(standbys []string, count int, quorum bool, strict bool) string {
+	if len(standbys) == 0 && strict {
+		return postgresql.BuildSynchronousStandbyNames(false, 1, []string{noSynchronousStandby})
+	}
+
+	return postgresql.BuildSynchronousStandbyNames(quorum, count, standbys)
+}
+
+func isSameSyncState(a, b dcs.SyncState) bool {
+	if a.Leader != b.Leader || a.Quorum != b.Quorum || a.Strict != b.Strict || len(a.Members) != len(b.Members) {
+		return false
+	}
+
+	for i := range a.Members {
+		if a.Members[i] != b.Members[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
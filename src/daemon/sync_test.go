@@ -0,0 +1,243 @@
+package daemon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+)
+
+func TestPickSynchronousStandbys(t *testing.T) {
+	stats := []postgresql.ReplicationStat{
+		{ApplicationName: "a"},
+		{ApplicationName: "b"},
+		{ApplicationName: "c"},
+		{ApplicationName: "nofailover"},
+		{ApplicationName: "stranger"},
+	}
+	instances := []dcs.InstanceInfo{
+		{Hostname: "leader", Role: postgresql.Leader},
+		{Hostname: "a", Role: postgresql.Replica},
+		{Hostname: "b", Role: postgresql.Replica},
+		{Hostname: "c", Role: postgresql.Replica},
+		{Hostname: "nofailover", Role: postgresql.Replica, Tags: dcs.Tags{dcs.TagNoFailover: "true"}},
+	}
+
+	tests := []struct {
+		name      string
+		syncState dcs.SyncState
+		count     int
+		quorum    bool
+		want      []string
+	}{
+		{
+			name:  "first count by flush position",
+			count: 1,
+			want:  []string{"a"},
+		},
+		{
+			name:      "current synchronous standbys are kept first",
+			syncState: dcs.SyncState{Members: []string{"c"}},
+			count:     2,
+			want:      []string{"c", "a"},
+		},
+		{
+			name:   "quorum takes every eligible standby",
+			count:  1,
+			quorum: true,
+			want:   []string{"a", "b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pickSynchronousStandbys(stats, instances, tt.syncState, tt.count, tt.quorum)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pickSynchronousStandbys = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildSyncState(t *testing.T) {
+	tests := []struct {
+		name     string
+		standbys []string
+		count    int
+		quorum   bool
+		want     dcs.SyncState
+	}{
+		{
+			name:     "first waits for every listed standby",
+			standbys: []string{"b", "a"},
+			count:    2,
+			want:     dcs.SyncState{Leader: "leader", Members: []string{"a", "b"}, Quorum: 2},
+		},
+		{
+			name:     "quorum waits for count standbys",
+			standbys: []string{"c", "a", "b"},
+			count:    2,
+			quorum:   true,
+			want:     dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 2},
+		},
+		{
+			name:     "quorum larger than the standbys",
+			standbys: []string{"a"},
+			count:    2,
+			quorum:   true,
+			want:     dcs.SyncState{Leader: "leader", Members: []string{"a"}, Quorum: 1},
+		},
+		{
+			name:     "no standbys",
+			standbys: []string{},
+			count:    1,
+			want:     dcs.SyncState{Leader: "leader", Members: []string{}, Quorum: 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildSyncState("leader", tt.standbys, tt.count, tt.quorum, false)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildSyncState = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWidenSyncState(t *testing.T) {
+	tests := []struct {
+		name    string
+		current dcs.SyncState
+		target  dcs.SyncState
+		want    dcs.SyncState
+	}{
+		{
+			name:    "a new standby joins the quorum",
+			current: dcs.SyncState{Leader: "leader", Members: []string{"a"}, Quorum: 1},
+			target:  dcs.SyncState{Leader: "leader", Members: []string{"a", "b"}, Quorum: 1},
+			want:    dcs.SyncState{Leader: "leader", Members: []string{"a", "b"}, Quorum: 1},
+		},
+		{
+			name:    "a standby is replaced",
+			current: dcs.SyncState{Leader: "leader", Members: []string{"a", "b"}, Quorum: 2},
+			target:  dcs.SyncState{Leader: "leader", Members: []string{"a", "c"}, Quorum: 2},
+			want:    dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 2},
+		},
+		{
+			name:    "the quorum decreases",
+			current: dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 2},
+			target:  dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 1},
+			want:    dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 1},
+		},
+		{
+			name:    "the quorum increases",
+			current: dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 1},
+			target:  dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 2},
+			want:    dcs.SyncState{Leader: "leader", Members: []string{"a", "b", "c"}, Quorum: 1},
+		},
+		{
+			name:    "no sync state yet",
+			current: dcs.SyncState{},
+			target:  dcs.SyncState{Leader: "leader", Members: []string{"a"}, Quorum: 1},
+			want:    dcs.SyncState{Leader: "leader", Members: []string{"a"}, Quorum: 1},
+		},
+		{
+			name:    "sync state of the former leader",
+			current: dcs.SyncState{Leader: "former", Members: []string{"leader", "a"}, Quorum: 1},
+			target:  dcs.SyncState{Leader: "leader", Members: []string{"a"}, Quorum: 1},
+			want:    dcs.SyncState{Leader: "leader", Members: []string{"a"}, Quorum: 1},
+		},
+		{
+			name:    "fall back to asynchronous replication",
+			current: dcs.SyncState{Leader: "leader", Members: []string{"a"}, Quorum: 1},
+			target:  dcs.SyncState{Leader: "leader", Members: []string{}, Quorum: 0},
+			want:    dcs.SyncState{Leader: "leader", Members: []string{"a"}, Quorum: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := widenSyncState(tt.current, tt.target)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("widenSyncState = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A commit acknowledged only by a standby which just joined the quorum must not be lost by promoting a standby recorded
+// before it joined
+func TestWidenSyncStateCoversNewStandby(t *testing.T) {
+	current := dcs.SyncState{Leader: "leader", Members: []string{"a"}, Quorum: 1}
+	target := dcs.SyncState{Leader: "leader", Members: []string{"a", "b"}, Quorum: 1}
+	widened := widenSyncState(current, target)
+
+	a := dcs.InstanceInfo{ID: "a", Hostname: "a"}
+	b := dcs.InstanceInfo{ID: "b", Hostname: "b"}
+
+	// Only a is left: it may lack the commits acknowledged by b alone
+	if ok, _ := checkSyncCandidate(a, []dcs.InstanceInfo{a}, widened); ok {
+		t.Fatalf("a was allowed to promote without b")
+	}
+
+	if ok, reason := checkSyncCandidate(a, []dcs.InstanceInfo{a, b}, widened); !ok {
+		t.Fatalf("a was not allowed to promote with b available: %v", reason)
+	}
+}
+
+func TestBuildSynchronousStandbyNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		standbys []string
+		count    int
+		quorum   bool
+		strict   bool
+		want     string
+	}{
+		{name: "first", standbys: []string{"a", "b"}, count: 2, want: `FIRST 2 ("a","b")`},
+		{name: "quorum", standbys: []string{"a", "b", "c"}, count: 1, quorum: true, want: `ANY 1 ("a","b","c")`},
+		{name: "no standby", count: 1, want: ""},
+		{name: "no standby in strict mode", count: 1, strict: true, want: `FIRST 1 ("seeone: no synchronous standby")`},
+		{name: "no standby in strict quorum mode", count: 2, quorum: true, strict: true, want: `FIRST 1 ("seeone: no synchronous standby")`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildSynchronousStandbyNames(tt.standbys, tt.count, tt.quorum, tt.strict)
+			if got != tt.want {
+				t.Errorf("buildSynchronousStandbyNames = %q, want %q", got, tt.want)
+			}
+			if tt.strict && strings.Contains(got, "*") {
+				t.Errorf("strict mode lets any standby acknowledge the commits: %q", got)
+			}
+		})
+	}
+}
+
+func TestIsSameSyncState(t *testing.T) {
+	base := dcs.SyncState{Leader: "leader", Members: []string{"a", "b"}, Quorum: 1}
+
+	tests := []struct {
+		name  string
+		other func(s dcs.SyncState) dcs.SyncState
+		want  bool
+	}{
+		{name: "same", other: func(s dcs.SyncState) dcs.SyncState { return s }, want: true},
+		{name: "leader", other: func(s dcs.SyncState) dcs.SyncState { s.Leader = "other"; return s }},
+		{name: "quorum", other: func(s dcs.SyncState) dcs.SyncState { s.Quorum = 2; return s }},
+		{name: "strict", other: func(s dcs.SyncState) dcs.SyncState { s.Strict = true; return s }},
+		{name: "members", other: func(s dcs.SyncState) dcs.SyncState { s.Members = []string{"a", "c"}; return s }},
+		{name: "fewer members", other: func(s dcs.SyncState) dcs.SyncState { s.Members = []string{"a"}; return s }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSameSyncState(base, tt.other(base)); got != tt.want {
+				t.Errorf("isSameSyncState = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"time"
+)
+
+// staleSlotGraceCycles is the number of cycles a slot must look stale before it is dropped: a replica switching upstream
+// creates its slot on the new upstream in observeLeader, but publishes the new upstream only at the end of its cycle
+const staleSlotGraceCycles = 3
+
+// pickCloneSource returns the hostname a new replica takes its base backup from: the running replica tagged clonefrom
+// with the least lag, the leader if there is none
+func pickCloneSource(self string, instances []dcs.InstanceInfo, leaderHostname string) string {
+	var source *dcs.InstanceInfo
+	for i, instance := range instances {
+		if instance.Hostname == self || !instance.Tags.CloneFrom() || !isRunningReplica(instance) {
+			continue
+		}
+
+		if source == nil || instance.Lag < source.Lag {
+			source = &instances[i]
+		}
+	}
+
+	if source == nil {
+		return leaderHostname
+	}
+
+	return source.Hostname
+}
+
+// pickUpstream returns the hostname the replica streams from: the member named by replicateFrom while it is running as
+// replica and does not stream from this instance itself, the leader otherwise
+func pickUpstream(self string, replicateFrom string, instances []dcs.InstanceInfo, leaderHostname string) string {
+	if replicateFrom == "" || replicateFrom == self || replicateFrom == leaderHostname {
+		return leaderHostname
+	}
+
+	for _, instance := range instances {
+		if instance.Hostname == replicateFrom && isRunningReplica(instance) && !streamsFrom(instance.Hostname, self, instances) {
+			return instance.Hostname
+		}
+	}
+
+	return leaderHostname
+}
+
+// streamsFrom tells if the member streams from hostname, directly or through other replicas, following the upstreams
+// the members published
+func streamsFrom(member string, hostname string, instances []dcs.InstanceInfo) bool {
+	upstreams := make(map[string]string)
+	for _, instance := range instances {
+		upstreams[instance.Hostname] = instance.Upstream
+	}
+
+	// A chain longer than the number of members is a loop which does not go through hostname
+	for i := 0; i < len(instances) && member != ""; i++ {
+		member = upstreams[member]
+		if member == hostname {
+			return true
+		}
+	}
+
+	return false
+}
+
+// staleReplicationSlots returns the inactive slots of the running replicas which stream from another member, they would
+// retain WAL forever. The slots of the replicas which are down are kept, they need them to catch up when they come back.
+// A slot is returned only once it looked stale for the grace period: staleSince keeps when each slot was first found
+// stale, and forgets the slots which are not anymore
+func staleReplicationSlots(self string, slots []postgresql.PhysicalSlot, instances []dcs.InstanceInfo, staleSince map[string]time.Time, now time.Time, grace time.Duration) []string {
+	candidates := make(map[string]bool)
+	for _, slot := range slots {
+		if slot.Active {
+			continue
+		}
+
+		for _, instance := range instances {
+			if instance.Hostname == slot.Name && isRunningReplica(instance) && instance.Upstream != "" && instance.Upstream != self {
+				candidates[slot.Name] = true
+			}
+		}
+	}
+
+	for name := range staleSince {
+		if !candidates[name] {
+			delete(staleSince, name)
+		}
+	}
+
+	stale := make([]string, 0)
+	for _, slot := range slots {
+		if !candidates[slot.Name] {
+			continue
+		}
+
+		since, ok := staleSince[slot.Name]
+		if !ok {
+			since = now
+			staleSince[slot.Name] = now
+		}
+
+		if now.Sub(since) >= grace {
+			stale = append(stale, slot.Name)
+		}
+	}
+
+	return stale
+}
+
+func isRunningReplica(instance dcs.InstanceInfo) bool {
+	return instance.Role == postgresql.Replica &&
+		instance.State == string(StateRunningReplica) &&
+		instance.PostgresState == postgresql.PostgresStateRunning
+}
+
+// replicateFrom returns the member this replica should stream from, empty meaning the leader. The topology of the
+// cluster config takes precedence over the replicatefrom tag
+func (d *Daemon) replicateFrom() string {
+	if upstream := d.Topology[d.Hostname]; upstream != "" {
+		return upstream
+	}
+
+	return d.Tags.ReplicateFrom()
+}
+
+// getUpstream is pickUpstream against the current cluster members, the leader is used if they cannot be read
+func (d *Daemon) getUpstream(ctx context.Context, leaderHostname string) string {
+	if d.replicateFrom() == "" {
+		return leaderHostname
+	}
+
+	instances, err := d.DcsProxy.GetClusterInstances(ctx)
+	if err != nil {
+		d.Log.Warningf("could not get cluster instances, streaming from the leader: %v", err)
+		return leaderHostname
+	}
+
+	return pickUpstream(d.Hostname, d.replicateFrom(), instances, leaderHostname)
+}
+
+// createReplicationSlot creates the slot of this instance on the member it streams from
+func (d *Daemon) createReplicationSlot(ctx context.Context, upstreamHostname string) error {
+	conn, err := d.Postmaster.ConnectTo(ctx, upstreamHostname)
+	if err != nil {
+		return fmt.Errorf("could not ConnectTo upstream at host %v: %v", upstreamHostname, err)
+	}
+	defer conn.Close(ctx)
+
+	if err := d.PgConfig.CreateReplicationSlot(ctx, conn, d.Hostname); err != nil {
+		return fmt.Errorf("could not CreateReplicationSlot on %v: %v", upstreamHostname, err)
+	}
+
+	return nil
+}
+
+// dropStaleReplicationSlots runs on every member with a running postgres, as any of them can be an upstream. Failures are
+// only logged, the next cycle tries again
+func (d *Daemon) dropStaleReplicationSlots(ctx context.Context) {
+	if state := d.State.Current(); state != StateRunningLeader && state != StateRunningReplica {
+		return
+	}
+
+	slots, err := d.Postmaster.GetReplicationSlots(ctx)
+	if err != nil {
+		d.Log.Warningf("could not get replication slots: %v", err)
+		return
+	}
+
+	instances, err := d.DcsProxy.GetClusterInstances(ctx)
+	if err != nil {
+		d.Log.Warningf("could not get cluster instances: %v", err)
+		return
+	}
+
+	if d.staleSlotsSince == nil {
+		d.staleSlotsSince = make(map[string]time.Time)
+	}
+
+	grace := staleSlotGraceCycles * time.Duration(d.TickDuration) * time.Second
+	for _, slot := range staleReplicationSlots(d.Hostname, slots, instances, d.staleSlotsSince, time.Now(), grace) {
+		d.Log.Infof("dropping replication slot %v, the replica streams from another member", slot)
+		if err := d.Postmaster.DropReplicationSlot(ctx, slot); err != nil {
+			d.Log.Warningf("could not drop replication slot %v: %v", slot, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+)
+
+func streamingReplica(hostname string, upstream string) dcs.InstanceInfo {
+	replica := runningReplica(hostname, 10000, nil)
+	replica.Upstream = upstream
+	return replica
+}
+
+func TestPickUpstream(t *testing.T) {
+	stopped := streamingReplica("stopped", "leader")
+	stopped.PostgresState = postgresql.PostgresStateStopped
+
+	instances := []dcs.InstanceInfo{
+		{Hostname: "leader", Role: postgresql.Leader, State: string(StateRunningLeader), PostgresState: postgresql.PostgresStateRunning},
+		streamingReplica("a", "leader"),
+		streamingReplica("b", "a"),
+		streamingReplica("c", "b"),
+		stopped,
+	}
+
+	tests := []struct {
+		name          string
+		self          string
+		replicateFrom string
+		want          string
+	}{
+		{name: "no replicatefrom", self: "b", want: "leader"},
+		{name: "running replica", self: "b", replicateFrom: "a", want: "a"},
+		{name: "itself", self: "b", replicateFrom: "b", want: "leader"},
+		{name: "the leader", self: "b", replicateFrom: "leader", want: "leader"},
+		{name: "unknown member", self: "b", replicateFrom: "unknown", want: "leader"},
+		{name: "stopped replica", self: "b", replicateFrom: "stopped", want: "leader"},
+		{name: "replica streaming from it", self: "a", replicateFrom: "b", want: "leader"},
+		{name: "replica streaming from it through another one", self: "a", replicateFrom: "c", want: "leader"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickUpstream(tt.self, tt.replicateFrom, instances, "leader"); got != tt.want {
+				t.Errorf("pickUpstream = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamsFrom(t *testing.T) {
+	instances := []dcs.InstanceInfo{
+		{Hostname: "leader"},
+		streamingReplica("a", "leader"),
+		streamingReplica("b", "a"),
+		streamingReplica("c", "b"),
+		// x and y stream from each other
+		streamingReplica("x", "y"),
+		streamingReplica("y", "x"),
+	}
+
+	tests := []struct {
+		name     string
+		member   string
+		hostname string
+		want     bool
+	}{
+		{name: "directly", member: "b", hostname: "a", want: true},
+		{name: "through another replica", member: "c", hostname: "a", want: true},
+		{name: "from the leader through the chain", member: "c", hostname: "leader", want: true},
+		{name: "upstream of the hostname", member: "a", hostname: "c", want: false},
+		{name: "itself", member: "a", hostname: "a", want: false},
+		{name: "unknown member", member: "unknown", hostname: "a", want: false},
+		{name: "loop not going through the hostname", member: "x", hostname: "a", want: false},
+		{name: "loop going through the hostname", member: "x", hostname: "y", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamsFrom(tt.member, tt.hostname, instances); got != tt.want {
+				t.Errorf("streamsFrom(%v, %v) = %v, want %v", tt.member, tt.hostname, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleReplicationSlots(t *testing.T) {
+	now := time.Now()
+	grace := 30 * time.Second
+
+	stopped := streamingReplica("stopped", "a")
+	stopped.PostgresState = postgresql.PostgresStateStopped
+
+	instances := []dcs.InstanceInfo{
+		streamingReplica("streams-from-self", "self"),
+		streamingReplica("streams-from-other", "a"),
+		streamingReplica("no-upstream", ""),
+		stopped,
+	}
+
+	tests := []struct {
+		name       string
+		slots      []postgresql.PhysicalSlot
+		staleSince map[string]time.Time
+		want       []string
+		wantSince  map[string]time.Time
+	}{
+		{
+			name:       "replica streaming from another member, first seen",
+			slots:      []postgresql.PhysicalSlot{{Name: "streams-from-other"}},
+			staleSince: map[string]time.Time{},
+			want:       []string{},
+			wantSince:  map[string]time.Time{"streams-from-other": now},
+		},
+		{
+			name:       "replica streaming from another member, within the grace period",
+			slots:      []postgresql.PhysicalSlot{{Name: "streams-from-other"}},
+			staleSince: map[string]time.Time{"streams-from-other": now.Add(-grace / 2)},
+			want:       []string{},
+			wantSince:  map[string]time.Time{"streams-from-other": now.Add(-grace / 2)},
+		},
+		{
+			name:       "replica streaming from another member, past the grace period",
+			slots:      []postgresql.PhysicalSlot{{Name: "streams-from-other"}},
+			staleSince: map[string]time.Time{"streams-from-other": now.Add(-grace)},
+			want:       []string{"streams-from-other"},
+			wantSince:  map[string]time.Time{"streams-from-other": now.Add(-grace)},
+		},
+		{
+			name:       "active slot",
+			slots:      []postgresql.PhysicalSlot{{Name: "streams-from-other", Active: true}},
+			staleSince: map[string]time.Time{"streams-from-other": now.Add(-grace)},
+			want:       []string{},
+			wantSince:  map[string]time.Time{},
+		},
+		{
+			name: "replicas streaming from this instance, without upstream, stopped or unknown",
+			slots: []postgresql.PhysicalSlot{
+				{Name: "streams-from-self"},
+				{Name: "no-upstream"},
+				{Name: "stopped"},
+				{Name: "unknown"},
+			},
+			staleSince: map[string]time.Time{"streams-from-self": now.Add(-grace)},
+			want:       []string{},
+			wantSince:  map[string]time.Time{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := staleReplicationSlots("self", tt.slots, instances, tt.staleSince, now, grace)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("staleReplicationSlots = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.staleSince, tt.wantSince) {
+				t.Errorf("staleSince = %v, want %v", tt.staleSince, tt.wantSince)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package dcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const configKey = "config"
+
+// ClusterConfig is the cluster wide configuration every node applies at each cycle, on top of its command line
+// flags. Every field is optional: an empty value leaves the node setting untouched
+type ClusterConfig struct {
+	// PostgresParameters are written in postgresql.conf after the template ones
+	PostgresParameters    map[string]string `json:"postgresql_parameters,omitempty"`
+	TTL                   int               `json:"ttl,omitempty"`
+	LoopWait              int               `json:"loop_wait,omitempty"`
+	MaximumLagOnFailover  *int64            `json:"maximum_lag_on_failover,omitempty"`
+	SynchronousMode       string            `json:"synchronous_mode,omitempty"`
+	SynchronousNodeCount  int               `json:"synchronous_node_count,omitempty"`
+	SynchronousModeStrict *bool             `json:"synchronous_mode_strict,omitempty"`
+	// Topology maps the hostname of a replica to the hostname of the member it streams from, it takes precedence over
+	// the replicatefrom tag
+	Topology map[string]string `json:"topology,omitempty"`
+}
+
+// Validate accepts zero values, Merge keeps the node setting for them
+func (c ClusterConfig) Validate() error {
+	if c.TTL < 0 {
+		return fmt.Errorf("ttl cannot be negative, got %v", c.TTL)
+	}
+
+	if c.LoopWait < 0 {
+		return fmt.Errorf("loop_wait cannot be negative, got %v", c.LoopWait)
+	}
+
+	if c.MaximumLagOnFailover != nil && *c.MaximumLagOnFailover < 0 {
+		return fmt.Errorf("maximum_lag_on_failover cannot be negative, got %v", *c.MaximumLagOnFailover)
+	}
+
+	switch c.SynchronousMode {
+	case "", "off", "on", "quorum":
+	default:
+		return fmt.Errorf("synchronous_mode must be one of off, on and quorum, got %q", c.SynchronousMode)
+	}
+
+	if c.SynchronousNodeCount < 0 {
+		return fmt.Errorf("synchronous_node_count cannot be negative, got %v", c.SynchronousNodeCount)
+	}
+
+	for replica, upstream := range c.Topology {
+		if replica == upstream {
+			return fmt.Errorf("topology: %v cannot stream from itself", replica)
+		}
+	}
+
+	return nil
+}
+
+// Merge returns the configuration with the fields set in other taking precedence, postgres parameters and topology
+// entries are merged one by one
+func (c ClusterConfig) Merge(other ClusterConfig) ClusterConfig {
+	merged := c
+	merged.PostgresParameters = make(map[string]string)
+	for name, value := range c.PostgresParameters {
+		merged.PostgresParameters[name] = value
+	}
+	for name, value := range other.PostgresParameters {
+		merged.PostgresParameters[name] = value
+	}
+
+	if other.TTL != 0 {
+		merged.TTL = other.TTL
+	}
+	if other.LoopWait != 0 {
+		merged.LoopWait = other.LoopWait
+	}
+	if other.MaximumLagOnFailover != nil {
+		merged.MaximumLagOnFailover = other.MaximumLagOnFailover
+	}
+	if other.SynchronousMode != "" {
+		merged.SynchronousMode = other.SynchronousMode
+	}
+	if other.SynchronousNodeCount != 0 {
+		merged.SynchronousNodeCount = other.SynchronousNodeCount
+	}
+	if other.SynchronousModeStrict != nil {
+		merged.SynchronousModeStrict = other.SynchronousModeStrict
+	}
+
+	merged.Topology = make(map[string]string)
+	for replica, upstream := range c.Topology {
+		merged.Topology[replica] = upstream
+	}
+	for replica, upstream := range other.Topology {
+		merged.Topology[replica] = upstream
+	}
+
+	return merged
+}
+
+// GetClusterConfig returns an empty ClusterConfig if none was saved yet
+func GetClusterConfig(ctx context.Context, client DCS) (ClusterConfig, error) {
+	data, err := client.GetClusterKey(ctx, configKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return ClusterConfig{}, nil
+	}
+	if err != nil {
+		return ClusterConfig{}, err
+	}
+
+	var c ClusterConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return ClusterConfig{}, fmt.Errorf("could not parse cluster config: %v", err)
+	}
+
+	return c, nil
+}
+
+func SaveClusterConfig(ctx context.Context, client DCS, c ClusterConfig) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return client.SetClusterKey(ctx, configKey, data)
+}
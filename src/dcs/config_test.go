@@ -0,0 +1,47 @@
+package dcs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClusterConfigValidate(t *testing.T) {
+	negativeLag := int64(-1)
+
+	tests := []struct {
+		name    string
+		config  ClusterConfig
+		wantErr string
+	}{
+		{name: "empty", config: ClusterConfig{}},
+		{name: "valid", config: ClusterConfig{TTL: 30, LoopWait: 10, SynchronousMode: "quorum", SynchronousNodeCount: 1}},
+		{name: "negative ttl", config: ClusterConfig{TTL: -1}, wantErr: "ttl cannot be negative"},
+		{name: "negative loop_wait", config: ClusterConfig{LoopWait: -1}, wantErr: "loop_wait cannot be negative"},
+		{name: "negative maximum_lag_on_failover", config: ClusterConfig{MaximumLagOnFailover: &negativeLag}, wantErr: "maximum_lag_on_failover cannot be negative"},
+		{name: "unknown synchronous_mode", config: ClusterConfig{SynchronousMode: "always"}, wantErr: "synchronous_mode must be one of"},
+		{name: "negative synchronous_node_count", config: ClusterConfig{SynchronousNodeCount: -1}, wantErr: "synchronous_node_count cannot be negative"},
+		{name: "replica streaming from itself", config: ClusterConfig{Topology: map[string]string{"a": "a"}}, wantErr: "cannot stream from itself"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// Zero values pass the validation because they leave the node setting untouched
+func TestClusterConfigMergeKeepsZeroValues(t *testing.T) {
+	node := ClusterConfig{TTL: 30, LoopWait: 10, SynchronousNodeCount: 2}
+
+	merged := node.Merge(ClusterConfig{LoopWait: 5})
+	if merged.TTL != 30 || merged.LoopWait != 5 || merged.SynchronousNodeCount != 2 {
+		t.Fatalf("unexpected merged config %+v", merged)
+	}
+}
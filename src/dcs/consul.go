@@ -0,0 +1,392 @@
+package dcs
+
+// https://developer.hashicorp.com/consul/tutorials/developer-configuration/application-leader-elections
+
+import (
+	"context"
+	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionKey = "session"
+
+	// The default lock delay is 15 seconds, which would delay every failover by the same amount
+	consulLockDelay = time.Millisecond
+)
+
+type Consul struct {
+	Log *logrus.Entry
+
+	cli        *api.Client
+	sessionID  string
+	stopRenew  chan struct{}
+	address    string
+	instanceID string
+	hostname   string
+	lease      int
+	keys       keyspace
+
+	// stopRenewOnce makes Disconnect safe to call more than once, the shutdown path and short lived clients both call it
+	stopRenewOnce sync.Once
+}
+
+func NewConsul(address string, config Config, log *logrus.Entry) *Consul {
+	return &Consul{
+		address:    address,
+		keys:       newKeyspace(config),
+		instanceID: config.InstanceID,
+		hostname:   config.Hostname,
+		lease:      config.Lease,
+		Log:        log,
+	}
+}
+
+func (c *Consul) Connect(ctx context.Context) error {
+	config := api.DefaultConfig()
+	if c.address != "" {
+		config.Address = c.address
+	}
+
+	cli, err := api.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	// The session is used both for the leader lock and for the instance info keys: when it is invalidated, because the
+	// instance stopped renewing it, every key held by it is deleted
+	sessionID, _, err := cli.Session().CreateNoChecks(&api.SessionEntry{
+		Name:      fmt.Sprintf("seeone-%v", c.instanceID),
+		TTL:       c.getTTL(),
+		Behavior:  api.SessionBehaviorDelete,
+		LockDelay: consulLockDelay,
+	}, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	c.cli = cli
+	c.sessionID = sessionID
+	c.stopRenew = make(chan struct{})
+
+	go func() {
+		if err := cli.Session().RenewPeriodic(c.getTTL(), sessionID, nil, c.stopRenew); err != nil {
+			c.Log.Errorf("could not renew consul session %v: %v", sessionID, err)
+		}
+	}()
+
+	return nil
+}
+
+func (c *Consul) GetRole(ctx context.Context) (string, error) {
+	leaderID, err := c.getLeaderID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if leaderID == c.instanceID {
+		return postgresql.Leader, nil
+	} else {
+		return postgresql.Replica, nil
+	}
+}
+
+// StartElection blocks until the leader lock is acquired, waiting for changes of the leader key with blocking queries
+func (c *Consul) StartElection(ctx context.Context) error {
+	var waitIndex uint64
+	for {
+		acquired, _, err := c.cli.KV().Acquire(&api.KVPair{
+			Key:     c.getLeaderKey(),
+			Value:   []byte(c.instanceID),
+			Session: c.sessionID,
+		}, (&api.WriteOptions{}).WithContext(ctx))
+		if err != nil {
+			return err
+		}
+
+		if acquired {
+			c.Log.Infof("acquired leader lock %v", c.getLeaderKey())
+			return nil
+		}
+
+		_, meta, err := c.cli.KV().Get(c.getLeaderKey(), (&api.QueryOptions{
+			WaitIndex: waitIndex,
+			WaitTime:  time.Duration(c.lease) * time.Second,
+		}).WithContext(ctx))
+		if err != nil {
+			return err
+		}
+
+		waitIndex = meta.LastIndex
+	}
+}
+
+func (c *Consul) SaveInstanceInfo(ctx context.Context, info InstanceInfo) error {
+	info.ID = c.instanceID
+	info.Hostname = c.hostname
+	data, err := marshalInstanceInfo(info)
+	if err != nil {
+		return err
+	}
+
+	if err := c.saveInstanceProp(ctx, instanceInfoKey, string(data)); err != nil {
+		return err
+	}
+
+	if err := c.saveInstanceProp(ctx, sessionKey, c.sessionID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Consul) GetLeaderInfo(ctx context.Context) (InstanceInfo, error) {
+	leaderID, err := c.getLeaderID(ctx)
+	if err != nil {
+		return InstanceInfo{}, err
+	}
+
+	return c.getInstanceInfo(ctx, leaderID)
+}
+
+func (c *Consul) GetClusterInstancesInfo(ctx context.Context) ([]InstanceInfo, error) {
+	pairs, _, err := c.cli.KV().List(c.getInstanceInfoPrefix()+"/", (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]InstanceInfo, 0)
+	for _, pair := range pairs {
+		if _, prop := c.parseInstanceProKey(pair.Key); prop != instanceInfoKey {
+			continue
+		}
+
+		instanceInfo, err := unmarshalInstanceInfo(pair.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		instances = append(instances, instanceInfo)
+	}
+
+	return instances, nil
+}
+
+// Promote moves the leader lock to the candidate session within a single transaction, so that there is no window in
+// which another instance could acquire it
+func (c *Consul) Promote(ctx context.Context, candidateInstanceID string) error {
+	leader, _, err := c.cli.KV().Get(c.getLeaderKey(), (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	candidateSession, _, err := c.cli.KV().Get(
+		c.getInstanceProKey(candidateInstanceID, sessionKey),
+		(&api.QueryOptions{}).WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+
+	if candidateSession == nil {
+		return fmt.Errorf("instance info with id %v not found", candidateInstanceID)
+	}
+
+	c.Log.Infof("candidate: %v", candidateInstanceID)
+	ops := api.KVTxnOps{}
+	if leader != nil && leader.Session != "" {
+		ops = append(ops, &api.KVTxnOp{
+			Verb:    api.KVUnlock,
+			Key:     c.getLeaderKey(),
+			Session: leader.Session,
+		})
+	}
+	ops = append(ops, &api.KVTxnOp{
+		Verb:    api.KVLock,
+		Key:     c.getLeaderKey(),
+		Value:   []byte(candidateInstanceID),
+		Session: string(candidateSession.Value),
+	})
+
+	ok, response, _, err := c.cli.KV().Txn(ops, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("could not hand over the leader lock to %v: %v", candidateInstanceID, response.Errors)
+	}
+
+	return nil
+}
+
+func (c *Consul) Demote(ctx context.Context) error {
+	c.Log.Debugf("resign leadership")
+	_, _, err := c.cli.KV().Release(&api.KVPair{
+		Key:     c.getLeaderKey(),
+		Session: c.sessionID,
+	}, (&api.WriteOptions{}).WithContext(ctx))
+
+	return err
+}
+
+// ObserveLeader watches the leader key with blocking queries
+func (c *Consul) ObserveLeader(ctx context.Context) <-chan string {
+	observer := make(chan string)
+	go func() {
+		defer close(observer)
+		var waitIndex, lastLockIndex uint64
+		lastLeaderID := ""
+		for {
+			leader, meta, err := c.cli.KV().Get(c.getLeaderKey(), (&api.QueryOptions{
+				WaitIndex: waitIndex,
+				WaitTime:  time.Duration(c.lease) * time.Second,
+			}).WithContext(ctx))
+			if err != nil {
+				c.Log.Warningf("stopped observing the leader key: %v", err)
+				return
+			}
+			waitIndex = meta.LastIndex
+
+			// Once the lock is released the same instance acquiring it again is a new leadership
+			if leader == nil || leader.Session == "" {
+				lastLeaderID = ""
+				continue
+			}
+
+			// LockIndex grows at every acquisition, a release and acquisition between two queries is noticed as well
+			if string(leader.Value) == lastLeaderID && leader.LockIndex == lastLockIndex {
+				continue
+			}
+
+			lastLeaderID = string(leader.Value)
+			lastLockIndex = leader.LockIndex
+			if !notifyLeader(ctx, observer, lastLeaderID) {
+				return
+			}
+		}
+	}()
+
+	return observer
+}
+
+func (c *Consul) GetClusterKey(ctx context.Context, key string) ([]byte, error) {
+	pair, _, err := c.cli.KV().Get(c.getClusterKey(key), (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if pair == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return pair.Value, nil
+}
+
+func (c *Consul) SetClusterKey(ctx context.Context, key string, value []byte) error {
+	_, err := c.cli.KV().Put(&api.KVPair{
+		Key:   c.getClusterKey(key),
+		Value: value,
+	}, (&api.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+func (c *Consul) DeleteClusterKey(ctx context.Context, key string) error {
+	_, err := c.cli.KV().Delete(c.getClusterKey(key), (&api.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+func (c *Consul) Disconnect() error {
+	c.Log.Debugf("destroying consul session")
+	// RenewPeriodic destroys the session once stopped
+	c.stopRenewOnce.Do(func() {
+		if c.stopRenew != nil {
+			close(c.stopRenew)
+		}
+	})
+
+	return nil
+}
+
+func (c *Consul) getLeaderID(ctx context.Context) (string, error) {
+	leader, _, err := c.cli.KV().Get(c.getLeaderKey(), (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+
+	// A released lock keeps its key, but without any session attached
+	if leader == nil || leader.Session == "" {
+		return "", fmt.Errorf("leader is not yet present in dcs")
+	}
+
+	return string(leader.Value), nil
+}
+
+func (c *Consul) getInstanceInfo(ctx context.Context, instanceID string) (InstanceInfo, error) {
+	pair, _, err := c.cli.KV().Get(
+		c.getInstanceProKey(instanceID, instanceInfoKey),
+		(&api.QueryOptions{}).WithContext(ctx),
+	)
+	if err != nil {
+		return InstanceInfo{}, err
+	}
+
+	if pair == nil {
+		return InstanceInfo{}, fmt.Errorf("instance info with id %v not found", instanceID)
+	}
+
+	return unmarshalInstanceInfo(pair.Value)
+}
+
+// saveInstanceProp acquires the key with the instance session, tying its lifetime to the session one
+func (c *Consul) saveInstanceProp(ctx context.Context, prop, val string) error {
+	acquired, _, err := c.cli.KV().Acquire(&api.KVPair{
+		Key:     c.getInstanceProKey(c.instanceID, prop),
+		Value:   []byte(val),
+		Session: c.sessionID,
+	}, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	if !acquired {
+		return fmt.Errorf("could not save instance property %v: session %v is not valid", prop, c.sessionID)
+	}
+
+	return nil
+}
+
+// Consul keys must not start with a slash
+func (c *Consul) getLeaderKey() string {
+	return strings.TrimPrefix(c.keys.leader(), "/")
+}
+
+func (c *Consul) getClusterKey(key string) string {
+	return strings.TrimPrefix(c.keys.cluster(key), "/")
+}
+
+func (c *Consul) getInstanceInfoPrefix() string {
+	return strings.TrimPrefix(c.keys.members(), "/")
+}
+
+func (c *Consul) getInstanceProKey(instanceID, prop string) string {
+	return fmt.Sprintf("%v/%v/%v", c.getInstanceInfoPrefix(), instanceID, prop)
+}
+
+func (c *Consul) parseInstanceProKey(key string) (string, string) {
+	parts := strings.Split(strings.TrimPrefix(key, c.getInstanceInfoPrefix()+"/"), "/")
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+func (c *Consul) getTTL() string {
+	return fmt.Sprintf("%vs", c.lease)
+}
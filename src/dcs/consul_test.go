@@ -0,0 +1,537 @@
+package dcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeConsul is an http stand-in for the consul agent, it implements the subset of the kv, session and txn endpoints
+// used by the Consul dcs, including blocking queries and the delete behavior of sessions
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	kv       map[string]*api.KVPair
+	sessions map[string]bool
+}
+
+func newFakeConsul(t *testing.T) *httptest.Server {
+	f := &fakeConsul{
+		changed:  make(chan struct{}),
+		kv:       make(map[string]*api.KVPair),
+		sessions: make(map[string]bool),
+	}
+
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		f.createSession(w)
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		f.renewSession(w, strings.TrimPrefix(r.URL.Path, "/v1/session/renew/"))
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		f.destroySession(w, strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+	case r.URL.Path == "/v1/txn":
+		f.txn(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		switch r.Method {
+		case http.MethodGet:
+			f.get(w, r, key)
+		case http.MethodPut:
+			f.put(w, r, key)
+		case http.MethodDelete:
+			f.delete(w, key)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeConsul) createSession(w http.ResponseWriter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := fmt.Sprintf("session-%v", len(f.sessions)+1)
+	f.sessions[id] = true
+	f.writeJSON(w, http.StatusOK, map[string]string{"ID": id})
+}
+
+func (f *fakeConsul) renewSession(w http.ResponseWriter, id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.sessions[id] {
+		f.writeJSON(w, http.StatusNotFound, nil)
+		return
+	}
+
+	f.writeJSON(w, http.StatusOK, []*api.SessionEntry{{ID: id, TTL: "10s"}})
+}
+
+func (f *fakeConsul) destroySession(w http.ResponseWriter, id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.sessions, id)
+	for key, pair := range f.kv {
+		if pair.Session == id {
+			delete(f.kv, key)
+		}
+	}
+	f.bump()
+	f.writeJSON(w, http.StatusOK, true)
+}
+
+func (f *fakeConsul) get(w http.ResponseWriter, r *http.Request, key string) {
+	f.mu.Lock()
+	if waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); waitIndex != 0 && waitIndex >= f.index {
+		changed := f.changed
+		wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+		if err != nil {
+			wait = time.Second
+		}
+
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+		}
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+
+	pairs := make([]*api.KVPair, 0)
+	if _, recurse := r.URL.Query()["recurse"]; recurse {
+		for k, pair := range f.kv {
+			if strings.HasPrefix(k, key) {
+				pairs = append(pairs, pair)
+			}
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	} else if pair, ok := f.kv[key]; ok {
+		pairs = append(pairs, pair)
+	}
+
+	if len(pairs) == 0 {
+		f.writeJSON(w, http.StatusNotFound, nil)
+		return
+	}
+
+	f.writeJSON(w, http.StatusOK, pairs)
+}
+
+func (f *fakeConsul) put(w http.ResponseWriter, r *http.Request, key string) {
+	value, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	switch {
+	case query.Get("acquire") != "":
+		f.writeJSON(w, http.StatusOK, f.lock(key, value, query.Get("acquire")))
+	case query.Get("release") != "":
+		pair, ok := f.kv[key]
+		released := ok && pair.Session == query.Get("release")
+		if released {
+			pair.Session = ""
+			f.bump()
+		}
+		f.writeJSON(w, http.StatusOK, released)
+	default:
+		f.set(key, value, "")
+		f.writeJSON(w, http.StatusOK, true)
+	}
+}
+
+func (f *fakeConsul) delete(w http.ResponseWriter, key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.kv, key)
+	f.bump()
+	f.writeJSON(w, http.StatusOK, true)
+}
+
+func (f *fakeConsul) txn(w http.ResponseWriter, r *http.Request) {
+	var ops api.TxnOps
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The operations are checked first, so that a failed transaction does not change anything
+	for i, op := range ops {
+		pair := f.kv[op.KV.Key]
+		var valid bool
+		switch op.KV.Verb {
+		case api.KVUnlock:
+			valid = pair != nil && pair.Session == op.KV.Session
+		case api.KVLock:
+			holder := ""
+			if pair != nil {
+				holder = pair.Session
+			}
+			// The lock can be taken if it is free or released by a preceding unlock of the same transaction
+			valid = f.sessions[op.KV.Session] && (holder == "" || holder == op.KV.Session || isUnlockedBy(ops[:i], op.KV.Key, holder))
+		}
+
+		if !valid {
+			f.writeJSON(w, http.StatusConflict, api.TxnResponse{
+				Errors: api.TxnErrors{{OpIndex: i, What: fmt.Sprintf("%v of %v failed", op.KV.Verb, op.KV.Key)}},
+			})
+			return
+		}
+	}
+
+	results := make(api.TxnResults, 0)
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case api.KVUnlock:
+			f.kv[op.KV.Key].Session = ""
+		case api.KVLock:
+			f.set(op.KV.Key, op.KV.Value, op.KV.Session)
+		}
+		results = append(results, &api.TxnResult{KV: f.kv[op.KV.Key]})
+	}
+	f.bump()
+
+	f.writeJSON(w, http.StatusOK, api.TxnResponse{Results: results})
+}
+
+// lock acquires the key for the session, like the acquire parameter of a kv put
+func (f *fakeConsul) lock(key string, value []byte, session string) bool {
+	if !f.sessions[session] {
+		return false
+	}
+
+	if pair, ok := f.kv[key]; ok && pair.Session != "" && pair.Session != session {
+		return false
+	}
+
+	f.set(key, value, session)
+	return true
+}
+
+func (f *fakeConsul) set(key string, value []byte, session string) {
+	pair, ok := f.kv[key]
+	if !ok {
+		pair = &api.KVPair{Key: key, CreateIndex: f.index + 1}
+		f.kv[key] = pair
+	}
+
+	if session != "" && pair.Session != session {
+		pair.LockIndex++
+	}
+	pair.Value = value
+	pair.Session = session
+	pair.ModifyIndex = f.index + 1
+	f.bump()
+}
+
+// bump advances the index and wakes up the blocking queries
+func (f *fakeConsul) bump() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.WriteHeader(status)
+	if body != nil {
+		_ = json.NewEncoder(w).Encode(body)
+	}
+}
+
+func isUnlockedBy(ops api.TxnOps, key string, session string) bool {
+	for _, op := range ops {
+		if op.KV.Verb == api.KVUnlock && op.KV.Key == key && op.KV.Session == session {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newTestConsul(t *testing.T, server *httptest.Server, instanceID string) *Consul {
+	t.Helper()
+
+	c := NewConsul(server.URL, Config{
+		Hostname:    instanceID + "-host",
+		InstanceID:  instanceID,
+		Lease:       10,
+		Namespace:   "seeone",
+		ClusterName: "postgresql",
+	}, logrus.NewEntry(logrus.New()))
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	return c
+}
+
+func TestConsulSaveAndListInstanceInfo(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeConsul(t)
+	a := newTestConsul(t, server, "a")
+	b := newTestConsul(t, server, "b")
+
+	if err := a.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Leader, Timeline: 2}); err != nil {
+		t.Fatalf("SaveInstanceInfo: %v", err)
+	}
+	if err := b.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Replica}); err != nil {
+		t.Fatalf("SaveInstanceInfo: %v", err)
+	}
+
+	instances, err := a.GetClusterInstancesInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetClusterInstancesInfo: %v", err)
+	}
+
+	// The session keys stored next to the instance info must not be listed
+	if len(instances) != 2 {
+		t.Fatalf("expected 2 instances, got %+v", instances)
+	}
+	if instances[0].ID != "a" || instances[0].Hostname != "a-host" || instances[0].Timeline != 2 {
+		t.Errorf("unexpected instance a: %+v", instances[0])
+	}
+	if instances[1].ID != "b" || instances[1].Role != postgresql.Replica {
+		t.Errorf("unexpected instance b: %+v", instances[1])
+	}
+}
+
+func TestConsulStartElection(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeConsul(t)
+	a := newTestConsul(t, server, "a")
+	b := newTestConsul(t, server, "b")
+
+	if _, err := a.GetRole(ctx); err == nil {
+		t.Fatalf("expected an error without a leader")
+	}
+
+	if err := a.StartElection(ctx); err != nil {
+		t.Fatalf("StartElection: %v", err)
+	}
+	for _, c := range []*Consul{a, b} {
+		if err := c.SaveInstanceInfo(ctx, InstanceInfo{}); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+	}
+
+	elected := make(chan error)
+	go func() { elected <- b.StartElection(ctx) }()
+
+	select {
+	case err := <-elected:
+		t.Fatalf("b was elected while a holds the lock: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := a.Demote(ctx); err != nil {
+		t.Fatalf("Demote: %v", err)
+	}
+
+	select {
+	case err := <-elected:
+		if err != nil {
+			t.Fatalf("StartElection: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("b was not elected after a resigned")
+	}
+
+	leader, err := a.GetLeaderInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetLeaderInfo: %v", err)
+	}
+	if leader.ID != "b" {
+		t.Fatalf("expected leader b, got %v", leader.ID)
+	}
+}
+
+func TestConsulPromote(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeConsul(t)
+	a := newTestConsul(t, server, "a")
+	b := newTestConsul(t, server, "b")
+
+	if err := a.StartElection(ctx); err != nil {
+		t.Fatalf("StartElection: %v", err)
+	}
+	for _, c := range []*Consul{a, b} {
+		if err := c.SaveInstanceInfo(ctx, InstanceInfo{}); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+	}
+
+	if err := a.Promote(ctx, "unknown"); err == nil {
+		t.Fatalf("expected an error promoting an unknown instance")
+	}
+
+	if err := a.Promote(ctx, "b"); err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+
+	for c, expected := range map[*Consul]string{a: postgresql.Replica, b: postgresql.Leader} {
+		role, err := c.GetRole(ctx)
+		if err != nil {
+			t.Fatalf("GetRole: %v", err)
+		}
+		if role != expected {
+			t.Errorf("instance %v: expected role %v, got %v", c.instanceID, expected, role)
+		}
+	}
+
+	// The lock is held by the candidate session, so it goes away with the candidate
+	leader, _, err := a.cli.KV().Get(a.getLeaderKey(), nil)
+	if err != nil {
+		t.Fatalf("get leader key: %v", err)
+	}
+	if leader.Session != b.sessionID {
+		t.Errorf("expected the leader key to be held by session %v, got %v", b.sessionID, leader.Session)
+	}
+}
+
+func TestConsulDisconnect(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeConsul(t)
+	a := newTestConsul(t, server, "a")
+	b := newTestConsul(t, server, "b")
+
+	if err := a.StartElection(ctx); err != nil {
+		t.Fatalf("StartElection: %v", err)
+	}
+	for _, c := range []*Consul{a, b} {
+		if err := c.SaveInstanceInfo(ctx, InstanceInfo{}); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+	}
+
+	if err := a.Disconnect(); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+	// Disconnecting twice must not panic on the closed renew channel
+	if err := a.Disconnect(); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+
+	// The session is destroyed in the background, along with every key it held
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		instances, err := b.GetClusterInstancesInfo(ctx)
+		if err != nil {
+			t.Fatalf("GetClusterInstancesInfo: %v", err)
+		}
+
+		if len(instances) == 1 && instances[0].ID == "b" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only instance b, got %+v", instances)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := b.GetRole(ctx); err == nil {
+		t.Fatalf("expected no leader once the leader session is destroyed")
+	}
+}
+
+func TestConsulClusterKeys(t *testing.T) {
+	ctx := context.Background()
+	c := newTestConsul(t, newFakeConsul(t), "a")
+
+	if _, err := c.GetClusterKey(ctx, "config"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err := c.SetClusterKey(ctx, "config", []byte("value")); err != nil {
+		t.Fatalf("SetClusterKey: %v", err)
+	}
+
+	value, err := c.GetClusterKey(ctx, "config")
+	if err != nil {
+		t.Fatalf("GetClusterKey: %v", err)
+	}
+	if string(value) != "value" {
+		t.Errorf("expected value, got %v", string(value))
+	}
+
+	if err := c.DeleteClusterKey(ctx, "config"); err != nil {
+		t.Fatalf("DeleteClusterKey: %v", err)
+	}
+	if _, err := c.GetClusterKey(ctx, "config"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestConsulObserveLeader(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeConsul(t)
+	a := newTestConsul(t, server, "a")
+	b := newTestConsul(t, server, "b")
+
+	observerCtx, cancelObserver := context.WithCancel(ctx)
+	defer cancelObserver()
+	observer := b.ObserveLeader(observerCtx)
+
+	expectLeader := func(expected string) {
+		t.Helper()
+		select {
+		case leaderID := <-observer:
+			if leaderID != expected {
+				t.Fatalf("expected to observe leader %v, got %v", expected, leaderID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("leader %v was not observed", expected)
+		}
+	}
+
+	if err := a.StartElection(ctx); err != nil {
+		t.Fatalf("StartElection: %v", err)
+	}
+	expectLeader("a")
+
+	// The same leader acquiring the lock again is a leadership change the observers must not miss
+	if err := a.Demote(ctx); err != nil {
+		t.Fatalf("Demote: %v", err)
+	}
+	if err := a.StartElection(ctx); err != nil {
+		t.Fatalf("StartElection: %v", err)
+	}
+	expectLeader("a")
+}
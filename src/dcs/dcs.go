@@ -1,33 +1,175 @@
 package dcs
 
-import "context"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"path"
+	"strings"
+	"time"
+)
 
 const (
-	hostnameKey = "hostname"
-	roleKey     = "role"
+	instanceInfoKey = "info"
+
+	leaderKey  = "leader"
+	membersKey = "members"
 )
 
 type DCS interface {
 	Connect(ctx context.Context) error
 	GetRole(ctx context.Context) (string, error)
 	StartElection(ctx context.Context) error
-	SaveInstanceInfo(ctx context.Context, role string) error
+	// SaveInstanceInfo publishes the instance status, id and hostname are always the ones of the dcs client
+	SaveInstanceInfo(ctx context.Context, info InstanceInfo) error
 	GetLeaderInfo(ctx context.Context) (InstanceInfo, error)
 	GetClusterInstancesInfo(ctx context.Context) ([]InstanceInfo, error)
 	Promote(ctx context.Context, candidateInstanceID string) error
 	Demote(ctx context.Context) error
+	// ObserveLeader returns a channel receiving the leader instance id every time the leadership changes,
+	// the channel is closed when the context is done or the watch cannot be kept alive
+	ObserveLeader(ctx context.Context) <-chan string
+	// GetClusterKey, SetClusterKey and DeleteClusterKey manage cluster wide keys, like the synchronous replication
+	// state: unlike the instance info they are not tied to the instance session. GetClusterKey returns
+	// ErrKeyNotFound if the key does not exist
+	GetClusterKey(ctx context.Context, key string) ([]byte, error)
+	SetClusterKey(ctx context.Context, key string, value []byte) error
+	DeleteClusterKey(ctx context.Context, key string) error
 	Disconnect() error
 }
 
+var ErrKeyNotFound = fmt.Errorf("key not found")
+
 type InstanceInfo struct {
 	ID       string `json:"id"`
 	Role     string `json:"role"`
 	Hostname string `json:"hostname"`
+	// State is the node lifecycle state, PostgresState is one of running, starting and stopped
+	State         string `json:"state"`
+	PostgresState string `json:"postgres_state"`
+	Timeline      int    `json:"timeline"`
+	// ReceivedLSN and ReplayedLSN are the WAL positions of a replica, for the leader both are its current WAL position
+	ReceivedLSN postgresql.LSN `json:"received_lsn"`
+	ReplayedLSN postgresql.LSN `json:"replayed_lsn"`
+	// Lag is the number of bytes of WAL the replica did not receive yet, according to the last leader position it saw
+	Lag             int64  `json:"lag"`
+	PostgresVersion string `json:"postgres_version"`
+	// PendingRestart is set when some of the changed parameters can only be applied by restarting postgres
+	PendingRestart           bool      `json:"pending_restart"`
+	PendingRestartParameters []string  `json:"pending_restart_parameters,omitempty"`
+	APIURL                   string    `json:"api_url"`
+	Tags                     Tags      `json:"tags,omitempty"`
+	LastHeartbeat            time.Time `json:"last_heartbeat"`
+	// Upstream is the hostname of the member a replica streams from
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// Every provider stores the instance info as a single json document, so that adding a field does not require a change
+// in every provider
+func marshalInstanceInfo(i InstanceInfo) ([]byte, error) {
+	return json.Marshal(i)
+}
+
+func unmarshalInstanceInfo(data []byte) (InstanceInfo, error) {
+	var i InstanceInfo
+	if err := json.Unmarshal(data, &i); err != nil {
+		return InstanceInfo{}, fmt.Errorf("could not parse instance info: %v", err)
+	}
+
+	return i, nil
 }
 
 type Config struct {
 	Hostname   string
 	InstanceID string
 	Lease      int
-	Namespace  string
+	// Namespace and ClusterName scope every key, so that many clusters can share the same dcs
+	Namespace   string
+	ClusterName string
+}
+
+func (c Config) validate() error {
+	if c.InstanceID == "" {
+		return fmt.Errorf("instance id is required")
+	}
+
+	if c.Hostname == "" {
+		return fmt.Errorf("hostname is required")
+	}
+
+	if c.Namespace == "" || strings.Contains(c.Namespace, "/") {
+		return fmt.Errorf("namespace must be a non empty string without slashes, got %q", c.Namespace)
+	}
+
+	if c.ClusterName == "" || strings.Contains(c.ClusterName, "/") {
+		return fmt.Errorf("cluster name must be a non empty string without slashes, got %q", c.ClusterName)
+	}
+
+	if c.Lease <= 0 {
+		return fmt.Errorf("lease must be greater than zero, got %v", c.Lease)
+	}
+
+	return nil
+}
+
+// keyspace builds the cluster keys: /<namespace>/<cluster name>/leader, /<namespace>/<cluster name>/members ...
+type keyspace struct {
+	namespace   string
+	clusterName string
+}
+
+func newKeyspace(config Config) keyspace {
+	return keyspace{namespace: config.Namespace, clusterName: config.ClusterName}
+}
+
+func (k keyspace) scope() string {
+	return path.Join("/", k.namespace, k.clusterName)
+}
+
+func (k keyspace) leader() string {
+	return path.Join(k.scope(), leaderKey)
+}
+
+func (k keyspace) members() string {
+	return path.Join(k.scope(), membersKey)
+}
+
+func (k keyspace) member(instanceID string) string {
+	return path.Join(k.members(), instanceID)
+}
+
+func (k keyspace) cluster(key string) string {
+	return path.Join(k.scope(), key)
+}
+
+// name returns the keyspace as a single dns subdomain, for providers like Kubernetes that do not support hierarchical
+// keys. The parts are joined with dots, which validateName keeps out of the namespace and the cluster name, so that two
+// clusters never share a name
+func (k keyspace) name(parts ...string) string {
+	return strings.Join(append([]string{k.namespace, k.clusterName}, parts...), ".")
+}
+
+// validateName checks that the namespace and the cluster name can be used by name, as dns labels
+func (k keyspace) validateName() error {
+	if errs := validation.IsDNS1123Label(k.namespace); len(errs) > 0 {
+		return fmt.Errorf("namespace %q is not a valid dns label: %v", k.namespace, strings.Join(errs, ", "))
+	}
+
+	if errs := validation.IsDNS1123Label(k.clusterName); len(errs) > 0 {
+		return fmt.Errorf("cluster name %q is not a valid dns label: %v", k.clusterName, strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// notifyLeader delivers the leader id to the observer, it returns false if the context is done in the meantime
+func notifyLeader(ctx context.Context, observer chan<- string, leaderID string) bool {
+	select {
+	case observer <- leaderID:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
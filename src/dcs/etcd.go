@@ -11,7 +11,6 @@ import (
 	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/concurrency"
-	"strings"
 )
 
 type Etcd struct {
@@ -25,18 +24,20 @@ type Etcd struct {
 	hostname        string
 	lease           int
 	endpoints       []string
+	keys            keyspace
 }
 
 func NewEtcdImpl(endpoints []string, config Config, log *logrus.Entry) *Etcd {
-	return newEtcdImpl(endpoints, config.Hostname, config.InstanceID, config.Lease, log)
+	return newEtcdImpl(endpoints, config.Hostname, config.InstanceID, config.Lease, newKeyspace(config), log)
 }
 
-func newEtcdImpl(endpoints []string, hostname string, instanceID string, lease int, log *logrus.Entry) *Etcd {
+func newEtcdImpl(endpoints []string, hostname string, instanceID string, lease int, keys keyspace, log *logrus.Entry) *Etcd {
 	return &Etcd{
 		endpoints:  endpoints,
 		hostname:   hostname,
 		instanceID: instanceID,
 		lease:      lease,
+		keys:       keys,
 		Log:        log,
 	}
 }
@@ -60,7 +61,7 @@ func (e *Etcd) Connect(ctx context.Context) error {
 	e.cli = cli
 	e.instanceSession = instanceSession
 	e.electionSession = leaderSession
-	e.election = concurrency.NewElection(leaderSession, postgresql.LeaderElectionPrefix)
+	e.election = concurrency.NewElection(leaderSession, e.keys.leader())
 
 	return nil
 }
@@ -73,31 +74,33 @@ func (e *Etcd) StartElection(ctx context.Context) error {
 	return e.election.Campaign(ctx, e.instanceID)
 }
 
-func (e *Etcd) SaveInstanceInfo(ctx context.Context, role string) error {
-	if err := e.saveInstanceProp(ctx, hostnameKey, e.hostname); err != nil {
-		return err
-	}
-
-	if err := e.saveInstanceProp(ctx, roleKey, role); err != nil {
+func (e *Etcd) SaveInstanceInfo(ctx context.Context, info InstanceInfo) error {
+	info.ID = e.instanceID
+	info.Hostname = e.hostname
+	data, err := marshalInstanceInfo(info)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	// The member key shares the election session lease: it goes away with the instance, even if it never campaigned
+	_, err = e.cli.Put(ctx, e.keys.member(e.instanceID), string(data), clientv3.WithLease(e.electionSession.Lease()))
+	return err
 }
 
 func (e *Etcd) GetLeaderInfo(ctx context.Context) (InstanceInfo, error) {
 	return e.getLeaderInfo(ctx)
 }
 
+// GetClusterInstancesInfo lists the member keys rather than the election ones, members tagged nofailover never campaign
 func (e *Etcd) GetClusterInstancesInfo(ctx context.Context) ([]InstanceInfo, error) {
-	electionResponse, err := e.electionSession.Client().Get(ctx, postgresql.LeaderElectionPrefix, clientv3.WithPrefix())
+	response, err := e.cli.Get(ctx, e.keys.members()+"/", clientv3.WithPrefix())
 	if err != nil {
 		return nil, err
 	}
 
 	instances := make([]InstanceInfo, 0)
-	for _, kv := range electionResponse.Kvs {
-		instanceInfo, err := e.getInstanceInfo(ctx, string(kv.Value))
+	for _, kv := range response.Kvs {
+		instanceInfo, err := unmarshalInstanceInfo(kv.Value)
 		if err != nil {
 			return nil, err
 		}
@@ -108,29 +111,62 @@ func (e *Etcd) GetClusterInstancesInfo(ctx context.Context) ([]InstanceInfo, err
 	return instances, nil
 }
 
+// Promote deletes, in a single transaction, every election key created before the candidate one, so the candidate
+// becomes the leader atomically. The deleted keys are then put back with their own lease: those instances join the
+// queue again behind the candidate
 func (e *Etcd) Promote(ctx context.Context, candidateInstanceID string) error {
-	response, err := e.electionSession.Client().Get(ctx, postgresql.LeaderElectionPrefix, clientv3.WithPrefix())
+	response, err := e.cli.Get(
+		ctx,
+		e.keys.leader()+"/",
+		clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend),
+	)
 	if err != nil {
 		return err
 	}
 
-	var candidate *mvccpb.KeyValue
-	for _, i := range response.Kvs {
-		if string(i.Value) == candidateInstanceID {
-			candidate = i
-			break
+	preceding := make([]*mvccpb.KeyValue, 0)
+	for _, kv := range response.Kvs {
+		if string(kv.Value) == candidateInstanceID {
+			e.Log.Infof("candidate: %v", candidateInstanceID)
+			return e.handOver(ctx, preceding)
 		}
+
+		preceding = append(preceding, kv)
 	}
 
-	e.Log.Infof("candidate: %+v", candidate)
-	// TODO: promote logic
-	// Apparently at the moment there is promotion logic in the election API
-	_, err = e.electionSession.Client().Put(
-		ctx,
-		string(candidate.Key),
-		candidateInstanceID,
-	)
-	return err
+	return fmt.Errorf("candidate %v is not taking part in the election", candidateInstanceID)
+}
+
+func (e *Etcd) handOver(ctx context.Context, preceding []*mvccpb.KeyValue) error {
+	if len(preceding) == 0 {
+		return nil
+	}
+
+	conditions := make([]clientv3.Cmp, 0)
+	deletes := make([]clientv3.Op, 0)
+	for _, kv := range preceding {
+		conditions = append(conditions, clientv3.Compare(clientv3.CreateRevision(string(kv.Key)), "=", kv.CreateRevision))
+		deletes = append(deletes, clientv3.OpDelete(string(kv.Key)))
+	}
+
+	response, err := e.cli.Txn(ctx).If(conditions...).Then(deletes...).Commit()
+	if err != nil {
+		return err
+	}
+
+	if !response.Succeeded {
+		return fmt.Errorf("the election queue changed during the promotion")
+	}
+
+	// A key whose lease expired in the meantime belongs to an instance which is gone anyway
+	for _, kv := range preceding {
+		if _, err := e.cli.Put(ctx, string(kv.Key), string(kv.Value), clientv3.WithLease(clientv3.LeaseID(kv.Lease))); err != nil {
+			e.Log.Warningf("could not put back election key of instance %s: %v", kv.Value, err)
+		}
+	}
+
+	return nil
 }
 
 func (e *Etcd) Demote(ctx context.Context) error {
@@ -141,6 +177,47 @@ func (e *Etcd) Demote(ctx context.Context) error {
 	return nil
 }
 
+func (e *Etcd) ObserveLeader(ctx context.Context) <-chan string {
+	observer := make(chan string)
+	go func() {
+		defer close(observer)
+		for response := range e.election.Observe(ctx) {
+			if len(response.Kvs) == 0 {
+				continue
+			}
+
+			if !notifyLeader(ctx, observer, string(response.Kvs[0].Value)) {
+				return
+			}
+		}
+	}()
+
+	return observer
+}
+
+func (e *Etcd) GetClusterKey(ctx context.Context, key string) ([]byte, error) {
+	response, err := e.cli.Get(ctx, e.keys.cluster(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Count == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	return response.Kvs[0].Value, nil
+}
+
+func (e *Etcd) SetClusterKey(ctx context.Context, key string, value []byte) error {
+	_, err := e.cli.Put(ctx, e.keys.cluster(key), string(value))
+	return err
+}
+
+func (e *Etcd) DeleteClusterKey(ctx context.Context, key string) error {
+	_, err := e.cli.Delete(ctx, e.keys.cluster(key))
+	return err
+}
+
 func (e *Etcd) Disconnect() error {
 	e.Log.Debugf("closing leader and instance sessions")
 	if err := e.electionSession.Close(); err != nil {
@@ -175,11 +252,7 @@ func (e *Etcd) getLeaderInfo(ctx context.Context) (InstanceInfo, error) {
 }
 
 func (e *Etcd) getInstanceInfo(ctx context.Context, instanceID string) (InstanceInfo, error) {
-	response, err := e.instanceSession.Client().Get(
-		ctx,
-		fmt.Sprintf("%v/%v", postgresql.InstanceInfoPrefix, instanceID),
-		clientv3.WithPrefix(),
-	)
+	response, err := e.instanceSession.Client().Get(ctx, e.keys.member(instanceID))
 	if err != nil {
 		return InstanceInfo{}, err
 	}
@@ -188,19 +261,7 @@ func (e *Etcd) getInstanceInfo(ctx context.Context, instanceID string) (Instance
 		return InstanceInfo{}, fmt.Errorf("instance info with id %v not found", instanceID)
 	}
 
-	i := InstanceInfo{
-		ID: instanceID,
-	}
-	for _, kv := range response.Kvs {
-		switch strings.Split(string(kv.Key), "/")[3] {
-		case hostnameKey:
-			i.Hostname = string(kv.Value)
-		case roleKey:
-			i.Role = string(kv.Value)
-		}
-	}
-
-	return i, nil
+	return unmarshalInstanceInfo(response.Kvs[0].Value)
 }
 
 func (e *Etcd) getRole(ctx context.Context) (string, error) {
@@ -219,27 +280,3 @@ func (e *Etcd) getRole(ctx context.Context) (string, error) {
 		return postgresql.Replica, nil
 	}
 }
-
-func (e *Etcd) saveInstanceProp(ctx context.Context, prop, val string) error {
-	if err := e.putKeyVal(ctx, e.getInstanceProKey(prop), val); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (e *Etcd) putKeyVal(ctx context.Context, key, val string) error {
-	if _, err := e.instanceSession.Client().Put(
-		ctx,
-		key,
-		val,
-	); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (e *Etcd) getInstanceProKey(prop string) string {
-	return fmt.Sprintf("%v/%v/%v", postgresql.InstanceInfoPrefix, e.instanceID, prop)
-}
@@ -1,20 +1,116 @@
 package dcs
 
-import "github.com/sirupsen/logrus"
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+)
 
+var ErrUnknownProvider = fmt.Errorf("unknown dcs provider")
+
+// Options holds the provider specific options, only the ones of the selected provider are validated
+type Options struct {
+	Etcd       EtcdOptions
+	Kubernetes KubernetesOptions
+	Consul     ConsulOptions
+	ZooKeeper  ZooKeeperOptions
+}
+
+type EtcdOptions struct {
+	Endpoints []string
+}
+
+type KubernetesOptions struct {
+	Namespace string
+}
+
+type ConsulOptions struct {
+	// Address of the consul agent, when empty the consul client default is used
+	Address string
+}
+
+type ZooKeeperOptions struct {
+	Servers []string
+}
+
+type providerConstructor func(options Options, config Config, log *logrus.Entry) (DCS, error)
+
+var providers = map[string]providerConstructor{
+	"etcd": func(options Options, config Config, log *logrus.Entry) (DCS, error) {
+		if len(options.Etcd.Endpoints) == 0 {
+			return nil, fmt.Errorf("at least one etcd endpoint is required")
+		}
+
+		return NewEtcdImpl(options.Etcd.Endpoints, config, log), nil
+	},
+	"kubernetes": func(options Options, config Config, log *logrus.Entry) (DCS, error) {
+		if options.Kubernetes.Namespace == "" {
+			return nil, fmt.Errorf("kubernetes namespace is required")
+		}
+
+		return NewKubernetes(options.Kubernetes.Namespace, config, log), nil
+	},
+	"consul": func(options Options, config Config, log *logrus.Entry) (DCS, error) {
+		// Consul does not accept session ttl lower than 10 seconds
+		if config.Lease < 10 {
+			return nil, fmt.Errorf("consul requires a lease of at least 10 seconds, got %v", config.Lease)
+		}
+
+		return NewConsul(options.Consul.Address, config, log), nil
+	},
+	"zookeeper": func(options Options, config Config, log *logrus.Entry) (DCS, error) {
+		if len(options.ZooKeeper.Servers) == 0 {
+			return nil, fmt.Errorf("at least one zookeeper server is required")
+		}
+
+		return NewZooKeeper(options.ZooKeeper.Servers, config, log), nil
+	},
+	"memory": func(options Options, config Config, log *logrus.Entry) (DCS, error) {
+		return NewMemory(getSharedMemoryStore(config), config, log), nil
+	},
+}
+
+// Factory builds the dcs provider lazily, so that only the options of the selected provider are required
 type Factory struct {
-	providers map[string]DCS
+	options Options
+	config  Config
+	log     *logrus.Entry
 }
 
-func NewFactory(endpoints []string, config Config, log *logrus.Entry) *Factory {
+func NewFactory(options Options, config Config, log *logrus.Entry) *Factory {
 	return &Factory{
-		map[string]DCS{
-			"etcd":       NewEtcdImpl(endpoints, config, log),
-			"kubernetes": NewKubernetes(config),
-		},
+		options: options,
+		config:  config,
+		log:     log,
+	}
+}
+
+func (f Factory) Get(providerName string) (DCS, error) {
+	constructor, ok := providers[providerName]
+	if !ok {
+		return nil, fmt.Errorf("%w %q, supported providers are: %v", ErrUnknownProvider, providerName, strings.Join(Providers(), ", "))
 	}
+
+	if err := f.config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %v configuration: %v", providerName, err)
+	}
+
+	dcsClient, err := constructor(f.options, f.config, f.log)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v configuration: %v", providerName, err)
+	}
+
+	return dcsClient, nil
 }
 
-func (f Factory) Get(providerName string) DCS {
-	return f.providers[providerName]
+// Providers returns the names of the supported dcs providers
+func Providers() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
 }
@@ -0,0 +1,63 @@
+package dcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const failoverKey = "failover"
+
+// Failover is a switchover or a failover requested through the api. For a switchover Leader is the instance id of the
+// leader the request is addressed to, it hands over the leadership to Candidate and removes the key whatever the
+// outcome. A failover has no Leader: the instance winning the election while the leader is down either promotes itself,
+// if it is the Candidate, or hands the leadership over to it. A scheduled switchover has no Leader either, it is run at
+// ScheduledAt by whichever instance is the leader then. HandedOver is set by the leader right before the handover of a
+// switchover: the key is then left to the Candidate, which removes it once it holds the leadership
+type Failover struct {
+	Leader      string     `json:"leader"`
+	Candidate   string     `json:"candidate"`
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+	HandedOver  bool       `json:"handed_over,omitempty"`
+}
+
+func (f Failover) IsSwitchover() bool {
+	return f.Leader != "" || f.ScheduledAt != nil
+}
+
+func (f Failover) IsDue(now time.Time) bool {
+	return f.ScheduledAt == nil || !now.Before(*f.ScheduledAt)
+}
+
+// GetFailover returns nil if no failover was requested
+func GetFailover(ctx context.Context, client DCS) (*Failover, error) {
+	data, err := client.GetClusterKey(ctx, failoverKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f Failover
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("could not parse failover: %v", err)
+	}
+
+	return &f, nil
+}
+
+func SaveFailover(ctx context.Context, client DCS, f Failover) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	return client.SetClusterKey(ctx, failoverKey, data)
+}
+
+func DeleteFailover(ctx context.Context, client DCS) error {
+	return client.DeleteClusterKey(ctx, failoverKey)
+}
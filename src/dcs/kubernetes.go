@@ -2,119 +2,489 @@ package dcs
 
 import (
 	"context"
+	"fmt"
 	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
 	"github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"sync"
 	"time"
 )
 
 // https://itnext.io/leader-election-in-kubernetes-using-client-go-a19cbe7a9a85
 
+const (
+	clusterLabel      = "seeone/cluster"
+	lastSeenKey       = "seeone/last-seen"
+	clusterKeyDataKey = "value"
+)
+
 type Kubernetes struct {
 	Log *logrus.Entry
 
-	kubeClient *clientset.Clientset
+	kubeClient clientset.Interface
 	elector    *leaderelection.LeaderElector
 	lock       *resourcelock.LeaseLock
 
+	// cancelElection stops the running elector, since ReleaseOnCancel is set the lease is released as well
+	cancelElection context.CancelFunc
+	// observers receive the new leader reported by the elector OnNewLeader callback
+	observers map[chan string]context.Context
+	mu        sync.Mutex
+	// instanceInfoMu serializes the updates of the instance info config map between SaveInstanceInfo and keepAlive
+	instanceInfoMu sync.Mutex
+	// cancelKeepAlive stops refreshing the last seen annotation of the instance info
+	cancelKeepAlive context.CancelFunc
+
 	instanceID string
 	namespace  string
 	hostname   string
 	lease      int
+	keys       keyspace
 }
 
-func NewKubernetes(config Config) *Kubernetes {
+func NewKubernetes(namespace string, config Config, log *logrus.Entry) *Kubernetes {
 	return &Kubernetes{
+		keys:       newKeyspace(config),
 		instanceID: config.InstanceID,
-		namespace:  config.Namespace,
+		namespace:  namespace,
 		hostname:   config.Hostname,
 		lease:      config.Lease,
+		Log:        log,
 	}
 }
 
+// NewKubernetesWithClient builds the Kubernetes dcs on top of an existing client, for example the client-go fake clientset,
+// Connect will not try to load the in cluster configuration
+func NewKubernetesWithClient(kubeClient clientset.Interface, namespace string, config Config, log *logrus.Entry) *Kubernetes {
+	k := NewKubernetes(namespace, config, log)
+	k.kubeClient = kubeClient
+	return k
+}
+
 func (k *Kubernetes) Connect(ctx context.Context) error {
-	config, err := rest.InClusterConfig()
-	if err != nil {
+	if err := k.keys.validateName(); err != nil {
 		return err
 	}
 
-	kubeClient := clientset.NewForConfigOrDie(config)
-	lock := &resourcelock.LeaseLock{
+	if k.kubeClient == nil {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return err
+		}
+
+		kubeClient, err := clientset.NewForConfig(config)
+		if err != nil {
+			return err
+		}
+
+		k.kubeClient = kubeClient
+	}
+
+	k.lock = &resourcelock.LeaseLock{
 		LeaseMeta: metav1.ObjectMeta{
-			Name:      postgresql.LeaderElectionPrefix,
+			Name:      k.getLeaseName(),
 			Namespace: k.namespace,
-			Annotations: map[string]string{
-				hostnameKey: k.hostname,
-			},
 		},
-		Client: kubeClient.CoordinationV1(),
+		Client: k.kubeClient.CoordinationV1(),
 		LockConfig: resourcelock.ResourceLockConfig{
 			Identity: k.instanceID,
 		},
 	}
+
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	k.cancelKeepAlive = cancel
+	go k.keepAlive(keepAliveCtx)
+
+	return nil
+}
+
+func (k *Kubernetes) GetRole(ctx context.Context) (string, error) {
+	leaderID, err := k.getLeaderID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if leaderID == k.instanceID {
+		return postgresql.Leader, nil
+	} else {
+		return postgresql.Replica, nil
+	}
+}
+
+// StartElection blocks until the leadership is lost or the election is cancelled by Demote or Disconnect
+func (k *Kubernetes) StartElection(ctx context.Context) error {
 	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
-		Lock:            lock,
+		Lock:            k.lock,
 		ReleaseOnCancel: true,
 		LeaseDuration:   time.Duration(k.lease) * time.Second,
-		RenewDeadline:   10 * time.Second,
+		RenewDeadline:   time.Duration(k.lease) * time.Second * 2 / 3,
 		RetryPeriod:     2 * time.Second,
 		Callbacks: leaderelection.LeaderCallbacks{
-			OnStartedLeading: func(c context.Context) {},
-			OnStoppedLeading: func() {},
-			OnNewLeader:      func(id string) {},
+			OnStartedLeading: func(c context.Context) {
+				k.Log.Infof("acquired leader lease %v", k.getLeaseName())
+			},
+			OnStoppedLeading: func() {
+				k.Log.Debugf("stopped leading or left the election")
+			},
+			OnNewLeader: func(id string) {
+				k.Log.Debugf("new leader observed: %v", id)
+				k.notifyObservers(id)
+			},
 		},
 	})
 	if err != nil {
 		return err
 	}
 
-	k.kubeClient = kubeClient
-	k.lock = lock
+	electionCtx, cancel := context.WithCancel(ctx)
+	k.mu.Lock()
 	k.elector = elector
+	k.cancelElection = cancel
+	k.mu.Unlock()
 
+	elector.Run(electionCtx)
 	return nil
 }
 
-func (k *Kubernetes) GetRole(ctx context.Context) (string, error) {
-	if k.elector.IsLeader() {
-		return postgresql.Leader, nil
-	} else {
-		return postgresql.Replica, nil
+func (k *Kubernetes) SaveInstanceInfo(ctx context.Context, info InstanceInfo) error {
+	k.instanceInfoMu.Lock()
+	defer k.instanceInfoMu.Unlock()
+
+	configMaps := k.kubeClient.CoreV1().ConfigMaps(k.namespace)
+	info.ID = k.instanceID
+	info.Hostname = k.hostname
+	instanceInfo, err := marshalInstanceInfo(info)
+	if err != nil {
+		return err
 	}
-}
+	data := map[string]string{
+		instanceInfoKey: string(instanceInfo),
+	}
+	lastSeen := time.Now().UTC().Format(time.RFC3339Nano)
 
-func (k *Kubernetes) StartElection(ctx context.Context) error {
-	k.elector.Run(ctx)
-	return nil
-}
+	configMap, err := configMaps.Get(ctx, k.getInstanceInfoName(k.instanceID), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err := configMaps.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        k.getInstanceInfoName(k.instanceID),
+				Namespace:   k.namespace,
+				Labels:      map[string]string{clusterLabel: k.keys.name()},
+				Annotations: map[string]string{lastSeenKey: lastSeen},
+			},
+			Data: data,
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
 
-func (k *Kubernetes) SaveInstanceInfo(ctx context.Context, role string) error {
-	//TODO implement me
-	panic("implement me")
+	if configMap.Annotations == nil {
+		configMap.Annotations = make(map[string]string)
+	}
+	configMap.Annotations[lastSeenKey] = lastSeen
+	configMap.Data = data
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
 }
 
 func (k *Kubernetes) GetLeaderInfo(ctx context.Context) (InstanceInfo, error) {
+	leaderID, err := k.getLeaderID(ctx)
+	if err != nil {
+		return InstanceInfo{}, err
+	}
 
-	return InstanceInfo{}, nil
+	return k.getInstanceInfo(ctx, leaderID)
 }
 
 func (k *Kubernetes) GetClusterInstancesInfo(ctx context.Context) ([]InstanceInfo, error) {
-	//TODO implement me
-	panic("implement me")
+	configMaps, err := k.kubeClient.CoreV1().ConfigMaps(k.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%v=%v", clusterLabel, k.keys.name()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]InstanceInfo, 0)
+	for _, configMap := range configMaps.Items {
+		if isInstanceInfoStale(configMap, time.Duration(k.lease)*time.Second) {
+			k.Log.Debugf("skipping stale instance info %v", configMap.Name)
+			continue
+		}
+
+		instanceInfo, err := configMapToInstanceInfo(configMap)
+		if err != nil {
+			return nil, err
+		}
+
+		instances = append(instances, instanceInfo)
+	}
+
+	return instances, nil
 }
 
+// Promote hands the lease off to the candidate: the current leader will fail to renew it and step down, while the
+// candidate elector will recognise itself as the holder on its next retry
 func (k *Kubernetes) Promote(ctx context.Context, candidateInstanceID string) error {
-	panic("implement me")
+	if _, err := k.getInstanceInfo(ctx, candidateInstanceID); err != nil {
+		return err
+	}
+
+	leases := k.kubeClient.CoordinationV1().Leases(k.namespace)
+	lease, err := leases.Get(ctx, k.getLeaseName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	k.Log.Infof("candidate: %v", candidateInstanceID)
+	record := resourcelock.LeaseSpecToLeaderElectionRecord(&lease.Spec)
+	if record.HolderIdentity != candidateInstanceID {
+		now := metav1.NewTime(time.Now())
+		record.LeaderTransitions++
+		record.HolderIdentity = candidateInstanceID
+		record.AcquireTime = now
+		record.RenewTime = now
+		record.LeaseDurationSeconds = k.lease
+	}
+
+	lease.Spec = resourcelock.LeaderElectionRecordToLeaseSpec(record)
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+func (k *Kubernetes) Demote(ctx context.Context) error {
+	k.Log.Debugf("resign leadership")
+	k.stopElection()
+	return nil
+}
+
+// ObserveLeader relies on the elector callbacks, therefore changes are observed only while the election is running
+func (k *Kubernetes) ObserveLeader(ctx context.Context) <-chan string {
+	observer := make(chan string, 1)
+
+	k.mu.Lock()
+	if k.observers == nil {
+		k.observers = make(map[chan string]context.Context)
+	}
+	k.observers[observer] = ctx
+	k.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		k.mu.Lock()
+		delete(k.observers, observer)
+		close(observer)
+		k.mu.Unlock()
+	}()
+
+	return observer
+}
+
+// Cluster keys are stored each in its own ConfigMap, without the cluster label so that they are not listed among the
+// instances
+func (k *Kubernetes) GetClusterKey(ctx context.Context, key string) ([]byte, error) {
+	configMap, err := k.kubeClient.CoreV1().ConfigMaps(k.namespace).Get(ctx, k.keys.name(key), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(configMap.Data[clusterKeyDataKey]), nil
+}
+
+func (k *Kubernetes) SetClusterKey(ctx context.Context, key string, value []byte) error {
+	configMaps := k.kubeClient.CoreV1().ConfigMaps(k.namespace)
+	data := map[string]string{clusterKeyDataKey: string(value)}
+
+	configMap, err := configMaps.Get(ctx, k.keys.name(key), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err := configMaps.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      k.keys.name(key),
+				Namespace: k.namespace,
+			},
+			Data: data,
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	configMap.Data = data
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
+
+func (k *Kubernetes) DeleteClusterKey(ctx context.Context, key string) error {
+	err := k.kubeClient.CoreV1().ConfigMaps(k.namespace).Delete(ctx, k.keys.name(key), metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (k *Kubernetes) notifyObservers(leaderID string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for observer, ctx := range k.observers {
+		// The callback must not block the elector: a slow observer will catch up with the daemon ticker
+		select {
+		case observer <- leaderID:
+		case <-ctx.Done():
+		default:
+		}
+	}
 }
 
 func (k *Kubernetes) Disconnect() error {
-	panic("implement me")
+	k.Log.Debugf("leaving the election and removing instance info")
+	k.stopElection()
+	if k.cancelKeepAlive != nil {
+		k.cancelKeepAlive()
+	}
+
+	err := k.kubeClient.CoreV1().ConfigMaps(k.namespace).Delete(
+		context.Background(),
+		k.getInstanceInfoName(k.instanceID),
+		metav1.DeleteOptions{},
+	)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
 }
 
-func (k *Kubernetes) Demote(ctx context.Context) error {
-	panic("implement me")
+// keepAlive refreshes the last seen annotation of the instance info well within the lease, like the etcd session
+// keepalive does: a member which stops refreshing it is considered gone once the lease would have expired
+func (k *Kubernetes) keepAlive(ctx context.Context) {
+	interval := time.Duration(k.lease) * time.Second / 3
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if err := k.touchInstanceInfo(ctx); err != nil {
+				k.Log.Warningf("could not refresh instance info: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// touchInstanceInfo updates the last seen annotation only, the instance info is left to SaveInstanceInfo
+func (k *Kubernetes) touchInstanceInfo(ctx context.Context) error {
+	k.instanceInfoMu.Lock()
+	defer k.instanceInfoMu.Unlock()
+
+	configMaps := k.kubeClient.CoreV1().ConfigMaps(k.namespace)
+	configMap, err := configMaps.Get(ctx, k.getInstanceInfoName(k.instanceID), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// Nothing was published yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if configMap.Annotations == nil {
+		configMap.Annotations = make(map[string]string)
+	}
+	configMap.Annotations[lastSeenKey] = time.Now().UTC().Format(time.RFC3339Nano)
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
+
+func (k *Kubernetes) stopElection() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.cancelElection != nil {
+		k.cancelElection()
+		k.cancelElection = nil
+	}
+}
+
+func (k *Kubernetes) getLeaderID(ctx context.Context) (string, error) {
+	lease, err := k.kubeClient.CoordinationV1().Leases(k.namespace).Get(ctx, k.getLeaseName(), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return "", fmt.Errorf("leader is not yet present in dcs")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if isLeaseExpired(lease) {
+		return "", fmt.Errorf("leader is not yet present in dcs")
+	}
+
+	return *lease.Spec.HolderIdentity, nil
+}
+
+func (k *Kubernetes) getInstanceInfo(ctx context.Context, instanceID string) (InstanceInfo, error) {
+	configMap, err := k.kubeClient.CoreV1().ConfigMaps(k.namespace).Get(
+		ctx,
+		k.getInstanceInfoName(instanceID),
+		metav1.GetOptions{},
+	)
+	if errors.IsNotFound(err) {
+		return InstanceInfo{}, fmt.Errorf("instance info with id %v not found", instanceID)
+	}
+	if err != nil {
+		return InstanceInfo{}, err
+	}
+
+	return configMapToInstanceInfo(*configMap)
+}
+
+// Kubernetes object names cannot contain slashes
+func (k *Kubernetes) getLeaseName() string {
+	return k.keys.name(leaderKey)
+}
+
+func (k *Kubernetes) getInstanceInfoName(instanceID string) string {
+	return k.keys.name(membersKey, instanceID)
+}
+
+func configMapToInstanceInfo(configMap corev1.ConfigMap) (InstanceInfo, error) {
+	return unmarshalInstanceInfo([]byte(configMap.Data[instanceInfoKey]))
+}
+
+// isInstanceInfoStale tells if the instance stopped refreshing its info for longer than the lease, it is gone the same
+// way an etcd member whose lease expired is
+func isInstanceInfoStale(configMap corev1.ConfigMap, ttl time.Duration) bool {
+	lastSeen, err := time.Parse(time.RFC3339Nano, configMap.Annotations[lastSeenKey])
+	if err != nil {
+		return true
+	}
+
+	return time.Since(lastSeen) > ttl
+}
+
+func isLeaseExpired(lease *coordinationv1.Lease) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	expiresAt := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	return time.Now().After(expiresAt)
 }
@@ -0,0 +1,450 @@
+package dcs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "default"
+
+func newTestKubernetes(t *testing.T, client clientset.Interface, instanceID string) *Kubernetes {
+	t.Helper()
+
+	return newTestKubernetesCluster(t, client, "seeone", "postgresql", instanceID)
+}
+
+func newTestKubernetesCluster(t *testing.T, client clientset.Interface, namespace, clusterName, instanceID string) *Kubernetes {
+	t.Helper()
+
+	k := NewKubernetesWithClient(client, testNamespace, Config{
+		Hostname:    instanceID + "-host",
+		InstanceID:  instanceID,
+		Lease:       10,
+		Namespace:   namespace,
+		ClusterName: clusterName,
+	}, logrus.NewEntry(logrus.New()))
+	if err := k.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { k.cancelKeepAlive() })
+
+	return k
+}
+
+func createTestLease(t *testing.T, k *Kubernetes, holder string) {
+	t.Helper()
+
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(k.lease)
+	_, err := k.kubeClient.CoordinationV1().Leases(testNamespace).Create(context.Background(), &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: k.getLeaseName(), Namespace: testNamespace},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+			LeaseDurationSeconds: &duration,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create lease: %v", err)
+	}
+}
+
+func TestKubernetesSaveAndListInstanceInfo(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	a := newTestKubernetes(t, client, "a")
+	b := newTestKubernetes(t, client, "b")
+
+	if err := a.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Leader}); err != nil {
+		t.Fatalf("SaveInstanceInfo: %v", err)
+	}
+	// The second save goes through the update path
+	if err := a.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Leader, Timeline: 2}); err != nil {
+		t.Fatalf("SaveInstanceInfo: %v", err)
+	}
+	if err := b.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Replica}); err != nil {
+		t.Fatalf("SaveInstanceInfo: %v", err)
+	}
+	// Cluster keys share the namespace but must not be listed as instances
+	if err := a.SetClusterKey(ctx, "config", []byte("{}")); err != nil {
+		t.Fatalf("SetClusterKey: %v", err)
+	}
+
+	instances, err := b.GetClusterInstancesInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetClusterInstancesInfo: %v", err)
+	}
+
+	got := make(map[string]InstanceInfo)
+	for _, instance := range instances {
+		got[instance.ID] = instance
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 instances, got %+v", instances)
+	}
+	if got["a"].Hostname != "a-host" || got["a"].Timeline != 2 || got["a"].Role != postgresql.Leader {
+		t.Errorf("unexpected instance a: %+v", got["a"])
+	}
+	if got["b"].Hostname != "b-host" || got["b"].Role != postgresql.Replica {
+		t.Errorf("unexpected instance b: %+v", got["b"])
+	}
+}
+
+func TestKubernetesSkipsStaleInstanceInfo(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	a := newTestKubernetes(t, client, "a")
+	b := newTestKubernetes(t, client, "b")
+
+	for _, k := range []*Kubernetes{a, b} {
+		if err := k.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Replica}); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+	}
+
+	// a died without disconnecting: its last seen is older than the lease
+	configMaps := client.CoreV1().ConfigMaps(testNamespace)
+	configMap, err := configMaps.Get(ctx, a.getInstanceInfoName("a"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get config map: %v", err)
+	}
+	configMap.Annotations[lastSeenKey] = time.Now().Add(-time.Duration(a.lease+1) * time.Second).UTC().Format(time.RFC3339Nano)
+	if _, err := configMaps.Update(ctx, configMap, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update config map: %v", err)
+	}
+
+	instances, err := b.GetClusterInstancesInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetClusterInstancesInfo: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ID != "b" {
+		t.Fatalf("expected only instance b, got %+v", instances)
+	}
+
+	// Refreshing the last seen annotation brings it back
+	if err := a.touchInstanceInfo(ctx); err != nil {
+		t.Fatalf("touchInstanceInfo: %v", err)
+	}
+	instances, err = b.GetClusterInstancesInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetClusterInstancesInfo: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("expected 2 instances, got %+v", instances)
+	}
+}
+
+func TestKubernetesGetLeaderInfoAndPromote(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	a := newTestKubernetes(t, client, "a")
+	b := newTestKubernetes(t, client, "b")
+
+	if _, err := a.GetLeaderInfo(ctx); err == nil {
+		t.Fatalf("expected an error without a lease")
+	}
+
+	for _, k := range []*Kubernetes{a, b} {
+		if err := k.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Replica}); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+	}
+	createTestLease(t, a, "a")
+
+	leader, err := b.GetLeaderInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetLeaderInfo: %v", err)
+	}
+	if leader.ID != "a" {
+		t.Fatalf("expected leader a, got %v", leader.ID)
+	}
+
+	if err := a.Promote(ctx, "unknown"); err == nil {
+		t.Fatalf("expected an error promoting an unknown instance")
+	}
+
+	if err := a.Promote(ctx, "b"); err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+
+	leader, err = a.GetLeaderInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetLeaderInfo: %v", err)
+	}
+	if leader.ID != "b" {
+		t.Fatalf("expected leader b, got %v", leader.ID)
+	}
+
+	for k, expected := range map[*Kubernetes]string{a: postgresql.Replica, b: postgresql.Leader} {
+		role, err := k.GetRole(ctx)
+		if err != nil {
+			t.Fatalf("GetRole: %v", err)
+		}
+		if role != expected {
+			t.Errorf("instance %v: expected role %v, got %v", k.instanceID, expected, role)
+		}
+	}
+
+	lease, err := client.CoordinationV1().Leases(testNamespace).Get(ctx, a.getLeaseName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get lease: %v", err)
+	}
+	if *lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("expected 1 lease transition, got %v", *lease.Spec.LeaseTransitions)
+	}
+}
+
+func TestKubernetesExpiredLease(t *testing.T) {
+	ctx := context.Background()
+	a := newTestKubernetes(t, fake.NewSimpleClientset(), "a")
+	createTestLease(t, a, "a")
+
+	leases := a.kubeClient.CoordinationV1().Leases(testNamespace)
+	lease, err := leases.Get(ctx, a.getLeaseName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get lease: %v", err)
+	}
+	renewTime := metav1.NewMicroTime(time.Now().Add(-time.Duration(a.lease+1) * time.Second))
+	lease.Spec.RenewTime = &renewTime
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update lease: %v", err)
+	}
+
+	if _, err := a.GetRole(ctx); err == nil {
+		t.Fatalf("expected an error with an expired lease")
+	}
+}
+
+func TestKubernetesDisconnect(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	a := newTestKubernetes(t, client, "a")
+	b := newTestKubernetes(t, client, "b")
+
+	for _, k := range []*Kubernetes{a, b} {
+		if err := k.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Replica}); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+	}
+
+	if err := a.Disconnect(); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+	// Disconnecting twice must not fail on the missing config map
+	if err := a.Disconnect(); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+
+	instances, err := b.GetClusterInstancesInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetClusterInstancesInfo: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ID != "b" {
+		t.Fatalf("expected only instance b, got %+v", instances)
+	}
+}
+
+func TestKubernetesClusterKeys(t *testing.T) {
+	ctx := context.Background()
+	k := newTestKubernetes(t, fake.NewSimpleClientset(), "a")
+
+	if _, err := k.GetClusterKey(ctx, "config"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	for _, value := range []string{"first", "second"} {
+		if err := k.SetClusterKey(ctx, "config", []byte(value)); err != nil {
+			t.Fatalf("SetClusterKey: %v", err)
+		}
+
+		got, err := k.GetClusterKey(ctx, "config")
+		if err != nil {
+			t.Fatalf("GetClusterKey: %v", err)
+		}
+		if string(got) != value {
+			t.Errorf("expected %v, got %v", value, string(got))
+		}
+	}
+
+	if err := k.DeleteClusterKey(ctx, "config"); err != nil {
+		t.Fatalf("DeleteClusterKey: %v", err)
+	}
+	if err := k.DeleteClusterKey(ctx, "config"); err != nil {
+		t.Fatalf("DeleteClusterKey of a missing key: %v", err)
+	}
+	if _, err := k.GetClusterKey(ctx, "config"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func waitForKubernetesRole(t *testing.T, k *Kubernetes, role string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if got, err := k.GetRole(context.Background()); err == nil && got == role {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("instance %v did not become %v", k.instanceID, role)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestKubernetesStartElection(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	a := newTestKubernetes(t, client, "a")
+	b := newTestKubernetes(t, client, "b")
+
+	observerCtx, cancelObserver := context.WithCancel(ctx)
+	defer cancelObserver()
+	observer := b.ObserveLeader(observerCtx)
+
+	aDone := make(chan error, 1)
+	go func() { aDone <- a.StartElection(ctx) }()
+	waitForKubernetesRole(t, a, postgresql.Leader)
+
+	bDone := make(chan error, 1)
+	go func() { bDone <- b.StartElection(ctx) }()
+	t.Cleanup(func() { b.stopElection() })
+
+	select {
+	case leaderID := <-observer:
+		if leaderID != "a" {
+			t.Fatalf("expected to observe leader a, got %v", leaderID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("b did not observe the leader")
+	}
+
+	if role, err := b.GetRole(ctx); err != nil || role != postgresql.Replica {
+		t.Fatalf("expected b to be a replica, got %v (%v)", role, err)
+	}
+
+	// Demote releases the lease, b takes it over at its next retry
+	if err := a.Demote(ctx); err != nil {
+		t.Fatalf("Demote: %v", err)
+	}
+	select {
+	case err := <-aDone:
+		if err != nil {
+			t.Fatalf("StartElection: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("StartElection did not return after Demote")
+	}
+
+	waitForKubernetesRole(t, b, postgresql.Leader)
+	if role, err := a.GetRole(ctx); err != nil || role != postgresql.Replica {
+		t.Fatalf("expected a to be a replica, got %v (%v)", role, err)
+	}
+
+	b.stopElection()
+	select {
+	case <-bDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("StartElection did not return after the election was stopped")
+	}
+}
+
+func TestKubernetesClusterNames(t *testing.T) {
+	cases := []struct {
+		name        string
+		namespace   string
+		clusterName string
+		valid       bool
+	}{
+		{name: "default names", namespace: "seeone", clusterName: "postgresql", valid: true},
+		{name: "dashes", namespace: "team-a", clusterName: "orders-db", valid: true},
+		{name: "underscore", namespace: "seeone", clusterName: "my_db"},
+		{name: "dot", namespace: "seeone.prod", clusterName: "postgresql"},
+		{name: "uppercase", namespace: "seeone", clusterName: "Orders"},
+		{name: "trailing dash", namespace: "seeone-", clusterName: "postgresql"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			k := NewKubernetesWithClient(fake.NewSimpleClientset(), testNamespace, Config{
+				Hostname:    "a-host",
+				InstanceID:  "a",
+				Lease:       10,
+				Namespace:   c.namespace,
+				ClusterName: c.clusterName,
+			}, logrus.NewEntry(logrus.New()))
+
+			err := k.Connect(context.Background())
+			if c.valid && err != nil {
+				t.Fatalf("Connect: %v", err)
+			}
+			if !c.valid && err == nil {
+				t.Fatalf("expected %q/%q to be rejected", c.namespace, c.clusterName)
+			}
+			if err == nil {
+				k.cancelKeepAlive()
+			}
+		})
+	}
+}
+
+func TestKubernetesClustersShareNamespace(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	// Both clusters used to be named a-b-c
+	first := newTestKubernetesCluster(t, client, "a", "b-c", "first")
+	second := newTestKubernetesCluster(t, client, "a-b", "c", "second")
+
+	if first.getLeaseName() == second.getLeaseName() {
+		t.Fatalf("both clusters use the lease %v", first.getLeaseName())
+	}
+
+	for _, k := range []*Kubernetes{first, second} {
+		go k.StartElection(ctx)
+		t.Cleanup(k.stopElection)
+		waitForKubernetesRole(t, k, postgresql.Leader)
+
+		if err := k.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Leader}); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+		if err := k.SetClusterKey(ctx, "config", []byte(k.instanceID)); err != nil {
+			t.Fatalf("SetClusterKey: %v", err)
+		}
+	}
+
+	for _, k := range []*Kubernetes{first, second} {
+		leader, err := k.GetLeaderInfo(ctx)
+		if err != nil {
+			t.Fatalf("GetLeaderInfo: %v", err)
+		}
+		if leader.ID != k.instanceID {
+			t.Errorf("expected %v to lead its own cluster, got %v", k.instanceID, leader.ID)
+		}
+
+		instances, err := k.GetClusterInstancesInfo(ctx)
+		if err != nil {
+			t.Fatalf("GetClusterInstancesInfo: %v", err)
+		}
+		if len(instances) != 1 || instances[0].ID != k.instanceID {
+			t.Errorf("expected only %v in its cluster, got %+v", k.instanceID, instances)
+		}
+
+		value, err := k.GetClusterKey(ctx, "config")
+		if err != nil {
+			t.Fatalf("GetClusterKey: %v", err)
+		}
+		if string(value) != k.instanceID {
+			t.Errorf("expected the config of %v, got %v", k.instanceID, string(value))
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package dcs
+
+import (
+	"context"
+	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The in memory dcs keeps the whole cluster state inside the process, it is meant for tests and for running several
+// instances on a single host without operating a real dcs. Every Memory client connected to the same MemoryStore
+// belongs to the same cluster.
+
+var (
+	ErrPartitioned = fmt.Errorf("instance is partitioned from the dcs")
+
+	// sharedMemoryStores are used by the Factory, one per cluster scope, so that instances of the same cluster created
+	// in the same process see each other
+	sharedMemoryStores   = make(map[string]*MemoryStore)
+	sharedMemoryStoresMu sync.Mutex
+)
+
+const memoryElectionPollInterval = 100 * time.Millisecond
+
+type MemoryStore struct {
+	mu sync.Mutex
+
+	// leases holds the expiration of every instance election lease
+	leases map[string]time.Time
+	// candidates is the election queue: the first candidate with a valid lease is the leader
+	candidates  []string
+	instances   map[string]InstanceInfo
+	clusterKeys map[string][]byte
+	partitioned map[string]bool
+	latency     time.Duration
+	// changed is closed and replaced every time the election state changes, waking up the campaigners
+	changed chan struct{}
+}
+
+func getSharedMemoryStore(config Config) *MemoryStore {
+	sharedMemoryStoresMu.Lock()
+	defer sharedMemoryStoresMu.Unlock()
+
+	scope := newKeyspace(config).scope()
+	if _, ok := sharedMemoryStores[scope]; !ok {
+		sharedMemoryStores[scope] = NewMemoryStore()
+	}
+
+	return sharedMemoryStores[scope]
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		leases:      make(map[string]time.Time),
+		candidates:  make([]string, 0),
+		instances:   make(map[string]InstanceInfo),
+		clusterKeys: make(map[string][]byte),
+		partitioned: make(map[string]bool),
+		changed:     make(chan struct{}),
+	}
+}
+
+// Partition makes every dcs call coming from the instance fail, its lease won't be renewed anymore and will expire
+func (s *MemoryStore) Partition(instanceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partitioned[instanceID] = true
+}
+
+// Heal removes a partition previously added with Partition
+func (s *MemoryStore) Heal(instanceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.partitioned, instanceID)
+}
+
+// ExpireLease immediately expires the instance election lease, as if it was not renewed in time
+func (s *MemoryStore) ExpireLease(instanceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revokeLease(instanceID)
+}
+
+// SetLatency delays every dcs call by the given duration
+func (s *MemoryStore) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// call simulates a round trip to the dcs and must be invoked, without holding the lock, before every operation
+func (s *MemoryStore) call(ctx context.Context, instanceID string) error {
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.partitioned[instanceID] {
+		return ErrPartitioned
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) grantLease(instanceID string, ttl time.Duration) {
+	s.leases[instanceID] = time.Now().Add(ttl)
+}
+
+// keepAlive renews the lease only if it is still valid: an expired lease is gone for good, like an etcd session
+func (s *MemoryStore) keepAlive(instanceID string, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireLeases()
+	if _, ok := s.leases[instanceID]; !ok || s.partitioned[instanceID] {
+		return false
+	}
+
+	s.grantLease(instanceID, ttl)
+	return true
+}
+
+func (s *MemoryStore) revokeLease(instanceID string) {
+	delete(s.leases, instanceID)
+	s.removeCandidate(instanceID)
+}
+
+func (s *MemoryStore) removeCandidate(instanceID string) {
+	for i, candidate := range s.candidates {
+		if candidate == instanceID {
+			s.candidates = append(s.candidates[:i], s.candidates[i+1:]...)
+			s.notify()
+			return
+		}
+	}
+}
+
+func (s *MemoryStore) isCandidate(instanceID string) bool {
+	for _, candidate := range s.candidates {
+		if candidate == instanceID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *MemoryStore) expireLeases() {
+	now := time.Now()
+	for instanceID, expiresAt := range s.leases {
+		if now.After(expiresAt) {
+			s.revokeLease(instanceID)
+		}
+	}
+}
+
+func (s *MemoryStore) leader() (string, bool) {
+	s.expireLeases()
+	if len(s.candidates) == 0 {
+		return "", false
+	}
+
+	return s.candidates[0], true
+}
+
+func (s *MemoryStore) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+type Memory struct {
+	Log *logrus.Entry
+
+	store           *MemoryStore
+	cancelKeepAlive context.CancelFunc
+	instanceID      string
+	hostname        string
+	lease           int
+}
+
+func NewMemory(store *MemoryStore, config Config, log *logrus.Entry) *Memory {
+	return &Memory{
+		store:      store,
+		instanceID: config.InstanceID,
+		hostname:   config.Hostname,
+		lease:      config.Lease,
+		Log:        log,
+	}
+}
+
+func (m *Memory) Connect(ctx context.Context) error {
+	if err := m.store.call(ctx, m.instanceID); err != nil {
+		return err
+	}
+
+	// The lease is granted on connection, as the instance info of a member which never campaigns expires with it
+	m.store.mu.Lock()
+	m.store.grantLease(m.instanceID, m.getTTL())
+	m.store.mu.Unlock()
+
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	m.cancelKeepAlive = cancel
+	go m.keepAlive(keepAliveCtx)
+
+	return nil
+}
+
+func (m *Memory) GetRole(ctx context.Context) (string, error) {
+	if err := m.store.call(ctx, m.instanceID); err != nil {
+		return "", err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	leaderID, ok := m.store.leader()
+	if !ok {
+		return "", fmt.Errorf("leader is not yet present in dcs")
+	}
+
+	if leaderID == m.instanceID {
+		return postgresql.Leader, nil
+	} else {
+		return postgresql.Replica, nil
+	}
+}
+
+// StartElection blocks until the instance becomes the leader, like etcd Campaign
+func (m *Memory) StartElection(ctx context.Context) error {
+	if err := m.store.call(ctx, m.instanceID); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	m.store.expireLeases()
+	if _, ok := m.store.leases[m.instanceID]; !ok {
+		m.store.grantLease(m.instanceID, m.getTTL())
+	}
+	// Like an etcd campaign, an instance already present in the queue keeps its position
+	if !m.store.isCandidate(m.instanceID) {
+		m.store.candidates = append(m.store.candidates, m.instanceID)
+		m.store.notify()
+	}
+	m.store.mu.Unlock()
+
+	for {
+		m.store.mu.Lock()
+		leaderID, _ := m.store.leader()
+		_, hasLease := m.store.leases[m.instanceID]
+		changed := m.store.changed
+		m.store.mu.Unlock()
+
+		if leaderID == m.instanceID {
+			return nil
+		}
+
+		if !hasLease {
+			return fmt.Errorf("election lease of instance %v expired", m.instanceID)
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(memoryElectionPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *Memory) SaveInstanceInfo(ctx context.Context, info InstanceInfo) error {
+	if err := m.store.call(ctx, m.instanceID); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	info.ID = m.instanceID
+	info.Hostname = m.hostname
+	m.store.instances[m.instanceID] = info
+
+	return nil
+}
+
+func (m *Memory) GetLeaderInfo(ctx context.Context) (InstanceInfo, error) {
+	if err := m.store.call(ctx, m.instanceID); err != nil {
+		return InstanceInfo{}, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	leaderID, ok := m.store.leader()
+	if !ok {
+		return InstanceInfo{}, fmt.Errorf("leader is not yet present in dcs")
+	}
+
+	return m.getInstanceInfo(leaderID)
+}
+
+// GetClusterInstancesInfo lists every instance holding a lease, members tagged nofailover never campaign
+func (m *Memory) GetClusterInstancesInfo(ctx context.Context) ([]InstanceInfo, error) {
+	if err := m.store.call(ctx, m.instanceID); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.expireLeases()
+	instanceIDs := make([]string, 0)
+	for instanceID := range m.store.leases {
+		if _, ok := m.store.instances[instanceID]; ok {
+			instanceIDs = append(instanceIDs, instanceID)
+		}
+	}
+	sort.Strings(instanceIDs)
+
+	instances := make([]InstanceInfo, 0)
+	for _, instanceID := range instanceIDs {
+		instances = append(instances, m.store.instances[instanceID])
+	}
+
+	return instances, nil
+}
+
+// Promote moves the candidate at the head of the election queue, handing over the leadership atomically
+func (m *Memory) Promote(ctx context.Context, candidateInstanceID string) error {
+	if err := m.store.call(ctx, m.instanceID); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.expireLeases()
+	for i, candidate := range m.store.candidates {
+		if candidate == candidateInstanceID {
+			m.store.candidates = append(m.store.candidates[:i], m.store.candidates[i+1:]...)
+			m.store.candidates = append([]string{candidateInstanceID}, m.store.candidates...)
+			m.store.notify()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("candidate %v is not taking part in the election", candidateInstanceID)
+}
+
+func (m *Memory) Demote(ctx context.Context) error {
+	m.Log.Debugf("resign leadership")
+	if err := m.store.call(ctx, m.instanceID); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.removeCandidate(m.instanceID)
+
+	return nil
+}
+
+func (m *Memory) ObserveLeader(ctx context.Context) <-chan string {
+	observer := make(chan string)
+	go func() {
+		defer close(observer)
+		lastLeaderID := ""
+		for {
+			m.store.mu.Lock()
+			leaderID, _ := m.store.leader()
+			changed := m.store.changed
+			m.store.mu.Unlock()
+
+			if leaderID != "" && leaderID != lastLeaderID {
+				if !notifyLeader(ctx, observer, leaderID) {
+					return
+				}
+				lastLeaderID = leaderID
+			}
+
+			// Leases expire without any notification, hence the polling
+			select {
+			case <-changed:
+			case <-time.After(memoryElectionPollInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return observer
+}
+
+func (m *Memory) GetClusterKey(ctx context.Context, key string) ([]byte, error) {
+	if err := m.store.call(ctx, m.instanceID); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	value, ok := m.store.clusterKeys[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return value, nil
+}
+
+func (m *Memory) SetClusterKey(ctx context.Context, key string, value []byte) error {
+	if err := m.store.call(ctx, m.instanceID); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.clusterKeys[key] = value
+
+	return nil
+}
+
+func (m *Memory) DeleteClusterKey(ctx context.Context, key string) error {
+	if err := m.store.call(ctx, m.instanceID); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	delete(m.store.clusterKeys, key)
+
+	return nil
+}
+
+func (m *Memory) Disconnect() error {
+	m.Log.Debugf("revoking election lease")
+	if m.cancelKeepAlive != nil {
+		m.cancelKeepAlive()
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.revokeLease(m.instanceID)
+
+	return nil
+}
+
+func (m *Memory) keepAlive(ctx context.Context) {
+	tick := time.NewTicker(m.getTTL() / 3)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			m.store.keepAlive(m.instanceID, m.getTTL())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *Memory) getInstanceInfo(instanceID string) (InstanceInfo, error) {
+	instanceInfo, ok := m.store.instances[instanceID]
+	if !ok {
+		return InstanceInfo{}, fmt.Errorf("instance info with id %v not found", instanceID)
+	}
+
+	return instanceInfo, nil
+}
+
+func (m *Memory) getTTL() time.Duration {
+	return time.Duration(m.lease) * time.Second
+}
@@ -0,0 +1,269 @@
+package dcs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestMemory(t *testing.T, store *MemoryStore, instanceID string) *Memory {
+	t.Helper()
+
+	m := NewMemory(store, Config{
+		Hostname:    instanceID + "-host",
+		InstanceID:  instanceID,
+		Lease:       1,
+		Namespace:   "seeone",
+		ClusterName: "postgresql",
+	}, logrus.NewEntry(logrus.New()))
+	if err := m.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { m.Disconnect() })
+
+	return m
+}
+
+// campaign runs the election in the background, the returned channel receives its outcome
+func campaign(m *Memory) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- m.StartElection(context.Background()) }()
+	return done
+}
+
+func waitForElection(t *testing.T, done <-chan error, instanceID string) {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("StartElection of %v: %v", instanceID, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%v did not win the election", instanceID)
+	}
+}
+
+func assertMemoryRole(t *testing.T, m *Memory, expected string) {
+	t.Helper()
+
+	role, err := m.GetRole(context.Background())
+	if err != nil {
+		t.Fatalf("GetRole of %v: %v", m.instanceID, err)
+	}
+	if role != expected {
+		t.Fatalf("expected %v to be %v, got %v", m.instanceID, expected, role)
+	}
+}
+
+func TestMemoryStartElection(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	a := newTestMemory(t, store, "a")
+	b := newTestMemory(t, store, "b")
+
+	if _, err := a.GetRole(ctx); err == nil {
+		t.Fatalf("expected an error without a leader")
+	}
+
+	waitForElection(t, campaign(a), "a")
+	bElection := campaign(b)
+
+	for _, m := range []*Memory{a, b} {
+		if err := m.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Replica}); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+	}
+
+	assertMemoryRole(t, a, postgresql.Leader)
+	assertMemoryRole(t, b, postgresql.Replica)
+
+	leader, err := b.GetLeaderInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetLeaderInfo: %v", err)
+	}
+	if leader.ID != "a" || leader.Hostname != "a-host" {
+		t.Fatalf("unexpected leader %+v", leader)
+	}
+
+	select {
+	case err := <-bElection:
+		t.Fatalf("b won the election while a is the leader: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := a.Demote(ctx); err != nil {
+		t.Fatalf("Demote: %v", err)
+	}
+	waitForElection(t, bElection, "b")
+	assertMemoryRole(t, b, postgresql.Leader)
+	assertMemoryRole(t, a, postgresql.Replica)
+}
+
+func TestMemoryExpireLease(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	a := newTestMemory(t, store, "a")
+	b := newTestMemory(t, store, "b")
+
+	for _, m := range []*Memory{a, b} {
+		if err := m.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Replica}); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+	}
+
+	observerCtx, cancelObserver := context.WithCancel(ctx)
+	defer cancelObserver()
+	observer := b.ObserveLeader(observerCtx)
+
+	waitForElection(t, campaign(a), "a")
+	bElection := campaign(b)
+	assertObservedLeader(t, observer, "a")
+
+	store.ExpireLease("a")
+	waitForElection(t, bElection, "b")
+	assertObservedLeader(t, observer, "b")
+	assertMemoryRole(t, b, postgresql.Leader)
+
+	// An expired lease takes the instance info with it
+	instances, err := b.GetClusterInstancesInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetClusterInstancesInfo: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ID != "b" {
+		t.Fatalf("expected only instance b, got %+v", instances)
+	}
+
+	// Campaigning again grants a new lease, at the back of the queue
+	aElection := campaign(a)
+	assertMemoryRole(t, a, postgresql.Replica)
+	if err := b.Disconnect(); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+	waitForElection(t, aElection, "a")
+	assertMemoryRole(t, a, postgresql.Leader)
+}
+
+func assertObservedLeader(t *testing.T, observer <-chan string, expected string) {
+	t.Helper()
+
+	select {
+	case leaderID := <-observer:
+		if leaderID != expected {
+			t.Fatalf("expected to observe leader %v, got %v", expected, leaderID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("leader %v was not observed", expected)
+	}
+}
+
+func TestMemoryPartition(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	a := newTestMemory(t, store, "a")
+	b := newTestMemory(t, store, "b")
+
+	waitForElection(t, campaign(a), "a")
+	bElection := campaign(b)
+
+	store.Partition("a")
+	if _, err := a.GetRole(ctx); !errors.Is(err, ErrPartitioned) {
+		t.Fatalf("expected ErrPartitioned, got %v", err)
+	}
+	if err := a.SaveInstanceInfo(ctx, InstanceInfo{}); !errors.Is(err, ErrPartitioned) {
+		t.Fatalf("expected ErrPartitioned, got %v", err)
+	}
+	if err := a.SetClusterKey(ctx, "config", []byte("{}")); !errors.Is(err, ErrPartitioned) {
+		t.Fatalf("expected ErrPartitioned, got %v", err)
+	}
+
+	// The partitioned leader cannot renew its lease, b takes over once it expires
+	waitForElection(t, bElection, "b")
+	assertMemoryRole(t, b, postgresql.Leader)
+
+	store.Heal("a")
+	assertMemoryRole(t, a, postgresql.Replica)
+}
+
+func TestMemoryLatency(t *testing.T) {
+	store := NewMemoryStore()
+	a := newTestMemory(t, store, "a")
+	waitForElection(t, campaign(a), "a")
+
+	store.SetLatency(200 * time.Millisecond)
+	timeout, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := a.GetRole(timeout); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the call to time out, got %v", err)
+	}
+
+	start := time.Now()
+	assertMemoryRole(t, a, postgresql.Leader)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("expected the call to take at least the latency, it took %v", elapsed)
+	}
+}
+
+func TestMemoryPromote(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	a := newTestMemory(t, store, "a")
+	b := newTestMemory(t, store, "b")
+	c := newTestMemory(t, store, "c")
+
+	waitForElection(t, campaign(a), "a")
+	bElection := campaign(b)
+	cElection := campaign(c)
+	// Both must be queued before the handover
+	time.Sleep(200 * time.Millisecond)
+
+	if err := a.Promote(ctx, "unknown"); err == nil {
+		t.Fatalf("expected an error promoting an instance which is not campaigning")
+	}
+
+	if err := a.Promote(ctx, "c"); err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+	waitForElection(t, cElection, "c")
+	assertMemoryRole(t, c, postgresql.Leader)
+	assertMemoryRole(t, a, postgresql.Replica)
+
+	select {
+	case err := <-bElection:
+		t.Fatalf("b won the election while c is the leader: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMemoryClusterKeys(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	a := newTestMemory(t, store, "a")
+	b := newTestMemory(t, store, "b")
+
+	if _, err := a.GetClusterKey(ctx, "config"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err := a.SetClusterKey(ctx, "config", []byte("value")); err != nil {
+		t.Fatalf("SetClusterKey: %v", err)
+	}
+	value, err := b.GetClusterKey(ctx, "config")
+	if err != nil {
+		t.Fatalf("GetClusterKey: %v", err)
+	}
+	if string(value) != "value" {
+		t.Fatalf("expected value, got %v", string(value))
+	}
+
+	if err := b.DeleteClusterKey(ctx, "config"); err != nil {
+		t.Fatalf("DeleteClusterKey: %v", err)
+	}
+	if _, err := a.GetClusterKey(ctx, "config"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package dcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const pauseKey = "pause"
+
+// Pause is set by an operator during a maintenance: while it is present the daemons only observe the cluster and
+// publish its status, they never promote, demote, restart or clone postgres
+type Pause struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// GetPause returns nil if the cluster is not paused
+func GetPause(ctx context.Context, client DCS) (*Pause, error) {
+	data, err := client.GetClusterKey(ctx, pauseKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p Pause
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("could not parse pause: %v", err)
+	}
+
+	return &p, nil
+}
+
+func SavePause(ctx context.Context, client DCS, p Pause) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	return client.SetClusterKey(ctx, pauseKey, data)
+}
+
+func DeletePause(ctx context.Context, client DCS) error {
+	return client.DeleteClusterKey(ctx, pauseKey)
+}
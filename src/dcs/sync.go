@@ -0,0 +1,62 @@
+package dcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const syncKey = "sync"
+
+// SyncState is the synchronous replication state written by the leader: every commit was acknowledged by at least
+// Quorum of the replicas listed by hostname in Members
+type SyncState struct {
+	Leader  string   `json:"leader"`
+	Members []string `json:"members"`
+	Quorum  int      `json:"quorum"`
+	// Strict is set when the leader keeps waiting for a synchronous standby even if none is available
+	Strict bool `json:"strict"`
+}
+
+// WritesBlocked tells if the leader commits are waiting for a synchronous standby to connect
+func (s SyncState) WritesBlocked() bool {
+	return s.Strict && len(s.Members) == 0
+}
+
+func (s SyncState) IsMember(hostname string) bool {
+	for _, member := range s.Members {
+		if member == hostname {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetSyncState returns an empty SyncState if the leader never wrote one
+func GetSyncState(ctx context.Context, client DCS) (SyncState, error) {
+	data, err := client.GetClusterKey(ctx, syncKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return SyncState{}, nil
+	}
+	if err != nil {
+		return SyncState{}, err
+	}
+
+	var s SyncState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return SyncState{}, fmt.Errorf("could not parse sync state: %v", err)
+	}
+
+	return s, nil
+}
+
+func SaveSyncState(ctx context.Context, client DCS, s SyncState) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return client.SetClusterKey(ctx, syncKey, data)
+}
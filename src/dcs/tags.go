@@ -0,0 +1,108 @@
+package dcs
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// TagNoFailover keeps the member out of the election, it can never become leader
+	TagNoFailover = "nofailover"
+	// TagNoLoadBalance asks load balancers not to route read only traffic to the member
+	TagNoLoadBalance = "noloadbalance"
+	// TagCloneFrom makes the member a preferred base backup source for new replicas
+	TagCloneFrom = "clonefrom"
+	// TagReplicateFrom is the hostname of the member the replica streams from, instead of the leader
+	TagReplicateFrom = "replicatefrom"
+	// TagFailoverPriority is a non negative integer, among the replicas that can promote the highest priority wins and
+	// zero means nofailover
+	TagFailoverPriority = "failover_priority"
+	// TagRecoveryMinApplyDelay is a duration like 1h30m the replica waits before replaying a commit, so that an
+	// accidental delete can be recovered from it. A delayed replica never becomes leader
+	TagRecoveryMinApplyDelay = "recovery_min_apply_delay"
+
+	DefaultFailoverPriority = 1
+)
+
+// Tags are set on the command line of every member and published with its instance info
+type Tags map[string]string
+
+func (t Tags) Validate() error {
+	for _, tag := range []string{TagNoFailover, TagNoLoadBalance, TagCloneFrom} {
+		if value, ok := t[tag]; ok {
+			if _, err := strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("tag %v must be a boolean, got %q", tag, value)
+			}
+		}
+	}
+
+	if value, ok := t[TagFailoverPriority]; ok {
+		if priority, err := strconv.Atoi(value); err != nil || priority < 0 {
+			return fmt.Errorf("tag %v must be a non negative integer, got %q", TagFailoverPriority, value)
+		}
+	}
+
+	if value, ok := t[TagRecoveryMinApplyDelay]; ok {
+		if delay, err := time.ParseDuration(value); err != nil || delay < 0 {
+			return fmt.Errorf("tag %v must be a non negative duration, got %q", TagRecoveryMinApplyDelay, value)
+		}
+	}
+
+	return nil
+}
+
+func (t Tags) NoFailover() bool {
+	return t.NoFailoverTag() != ""
+}
+
+// NoFailoverTag returns the tag keeping the member out of the election, empty if there is none
+func (t Tags) NoFailoverTag() string {
+	switch {
+	case t.isSet(TagNoFailover):
+		return TagNoFailover
+	case t.FailoverPriority() == 0:
+		return TagFailoverPriority
+	case t.RecoveryMinApplyDelay() > 0:
+		return TagRecoveryMinApplyDelay
+	}
+
+	return ""
+}
+
+// FailoverPriority returns DefaultFailoverPriority when the tag is not set or invalid
+func (t Tags) FailoverPriority() int {
+	priority, err := strconv.Atoi(t[TagFailoverPriority])
+	if err != nil || priority < 0 {
+		return DefaultFailoverPriority
+	}
+
+	return priority
+}
+
+// RecoveryMinApplyDelay returns zero when the tag is not set or invalid
+func (t Tags) RecoveryMinApplyDelay() time.Duration {
+	delay, err := time.ParseDuration(t[TagRecoveryMinApplyDelay])
+	if err != nil || delay < 0 {
+		return 0
+	}
+
+	return delay
+}
+
+func (t Tags) NoLoadBalance() bool {
+	return t.isSet(TagNoLoadBalance)
+}
+
+func (t Tags) CloneFrom() bool {
+	return t.isSet(TagCloneFrom)
+}
+
+func (t Tags) ReplicateFrom() string {
+	return t[TagReplicateFrom]
+}
+
+func (t Tags) isSet(tag string) bool {
+	isSet, _ := strconv.ParseBool(t[tag])
+	return isSet
+}
@@ -0,0 +1,486 @@
+package dcs
+
+// https://zookeeper.apache.org/doc/current/recipes.html#sc_leaderElection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/go-zookeeper/zk"
+	"github.com/sirupsen/logrus"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const electionNodePrefix = "n_"
+
+// zkConn is the part of the zookeeper connection used by the dcs, tests replace it with an in memory fake
+type zkConn interface {
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Exists(path string) (bool, *zk.Stat, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	Delete(path string, version int32) error
+	Multi(ops ...interface{}) ([]zk.MultiResponse, error)
+	SessionID() int64
+	Close()
+}
+
+type ZooKeeper struct {
+	Log *logrus.Entry
+
+	conn zkConn
+	// electionNode is the ephemeral sequential znode this instance created to take part to the election
+	electionNode string
+	servers      []string
+	instanceID   string
+	hostname     string
+	lease        int
+	keys         keyspace
+}
+
+func NewZooKeeper(servers []string, config Config, log *logrus.Entry) *ZooKeeper {
+	return &ZooKeeper{
+		keys:       newKeyspace(config),
+		servers:    servers,
+		instanceID: config.InstanceID,
+		hostname:   config.Hostname,
+		lease:      config.Lease,
+		Log:        log,
+	}
+}
+
+// newZooKeeperWithConn builds the ZooKeeper dcs on top of an existing connection, Connect will not open a new one
+func newZooKeeperWithConn(conn zkConn, config Config, log *logrus.Entry) *ZooKeeper {
+	z := NewZooKeeper(nil, config, log)
+	z.conn = conn
+	return z
+}
+
+func (z *ZooKeeper) Connect(ctx context.Context) error {
+	conn := z.conn
+	if conn == nil {
+		// The session timeout is what makes the ephemeral znodes go away, it plays the same role as the etcd lease
+		zkConn, _, err := zk.Connect(z.servers, time.Duration(z.lease)*time.Second, zk.WithLogger(z.Log))
+		if err != nil {
+			return err
+		}
+		conn = zkConn
+	}
+
+	for _, p := range []string{z.keys.leader(), z.keys.members()} {
+		if err := createPersistentPath(conn, p); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	z.conn = conn
+	return nil
+}
+
+func (z *ZooKeeper) GetRole(ctx context.Context) (string, error) {
+	leaderID, err := z.getLeaderID()
+	if err != nil {
+		return "", err
+	}
+
+	if leaderID == z.instanceID {
+		return postgresql.Leader, nil
+	} else {
+		return postgresql.Replica, nil
+	}
+}
+
+// StartElection blocks until this instance owns the lowest election znode, watching only its predecessor to avoid
+// the herd effect
+func (z *ZooKeeper) StartElection(ctx context.Context) error {
+	if err := z.ensureElectionNode(); err != nil {
+		return err
+	}
+
+	for {
+		nodes, err := z.getElectionNodes()
+		if err != nil {
+			return err
+		}
+
+		position := -1
+		for i, node := range nodes {
+			if node == path.Base(z.electionNode) {
+				position = i
+				break
+			}
+		}
+
+		if position == -1 {
+			// Our znode was removed, either by a promotion or because the session expired: join the queue again
+			if err := z.adoptElectionNode(nodes); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if position == 0 {
+			z.Log.Infof("acquired leadership with znode %v", z.electionNode)
+			return nil
+		}
+
+		exists, _, event, err := z.conn.ExistsW(path.Join(z.keys.leader(), nodes[position-1]))
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			continue
+		}
+
+		select {
+		case <-event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SaveInstanceInfo stores the whole instance info in a single ephemeral znode, as ephemeral znodes cannot have children
+func (z *ZooKeeper) SaveInstanceInfo(ctx context.Context, info InstanceInfo) error {
+	info.ID = z.instanceID
+	info.Hostname = z.hostname
+	data, err := marshalInstanceInfo(info)
+	if err != nil {
+		return err
+	}
+
+	instanceNode := path.Join(z.keys.members(), z.instanceID)
+	if _, err := z.conn.Set(instanceNode, data, -1); err == nil {
+		return nil
+	} else if !errors.Is(err, zk.ErrNoNode) {
+		return err
+	}
+
+	_, err = z.conn.Create(instanceNode, data, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	return err
+}
+
+func (z *ZooKeeper) GetLeaderInfo(ctx context.Context) (InstanceInfo, error) {
+	leaderID, err := z.getLeaderID()
+	if err != nil {
+		return InstanceInfo{}, err
+	}
+
+	return z.getInstanceInfo(leaderID)
+}
+
+// GetClusterInstancesInfo lists the ephemeral member znodes rather than the election ones, members tagged nofailover
+// never campaign
+func (z *ZooKeeper) GetClusterInstancesInfo(ctx context.Context) ([]InstanceInfo, error) {
+	instanceIDs, _, err := z.conn.Children(z.keys.members())
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]InstanceInfo, 0)
+	for _, instanceID := range instanceIDs {
+		data, _, err := z.conn.Get(path.Join(z.keys.members(), instanceID))
+		if errors.Is(err, zk.ErrNoNode) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		instanceInfo, err := unmarshalInstanceInfo(data)
+		if err != nil {
+			return nil, err
+		}
+
+		instances = append(instances, instanceInfo)
+	}
+
+	return instances, nil
+}
+
+// Promote deletes, in a single transaction, every election znode preceding the candidate one, so the candidate
+// becomes the lowest znode. The deleted znodes are then created again behind the candidate, like Etcd.handOver puts
+// back the keys: the instances keep their place in the election without campaigning again
+func (z *ZooKeeper) Promote(ctx context.Context, candidateInstanceID string) error {
+	nodes, err := z.getElectionNodes()
+	if err != nil {
+		return err
+	}
+
+	ops := make([]interface{}, 0)
+	preceding := make([]string, 0)
+	for _, node := range nodes {
+		nodePath := path.Join(z.keys.leader(), node)
+		instanceID, stat, err := z.conn.Get(nodePath)
+		if err != nil {
+			return err
+		}
+
+		if string(instanceID) == candidateInstanceID {
+			z.Log.Infof("candidate: %v", candidateInstanceID)
+			if len(ops) == 0 {
+				return nil
+			}
+
+			if _, err := z.conn.Multi(ops...); err != nil {
+				return err
+			}
+
+			z.requeue(preceding)
+			return nil
+		}
+
+		ops = append(ops, &zk.DeleteRequest{Path: nodePath, Version: stat.Version})
+		preceding = append(preceding, string(instanceID))
+	}
+
+	return fmt.Errorf("candidate %v is not taking part in the election", candidateInstanceID)
+}
+
+// requeue creates again the election znodes deleted by a promotion. The znodes of the other instances belong to this
+// session until they replace them with their own, see adoptElectionNode
+func (z *ZooKeeper) requeue(instanceIDs []string) {
+	for _, instanceID := range instanceIDs {
+		var err error
+		if instanceID == z.instanceID {
+			err = z.createElectionNode()
+		} else {
+			_, err = z.conn.Create(
+				path.Join(z.keys.leader(), electionNodePrefix),
+				[]byte(instanceID),
+				zk.FlagEphemeral|zk.FlagSequence,
+				zk.WorldACL(zk.PermAll),
+			)
+		}
+
+		if err != nil {
+			z.Log.Warningf("could not put back election znode of instance %v: %v", instanceID, err)
+		}
+	}
+}
+
+func (z *ZooKeeper) Demote(ctx context.Context) error {
+	z.Log.Debugf("resign leadership")
+	if z.electionNode == "" {
+		return nil
+	}
+
+	if err := z.conn.Delete(z.electionNode, -1); err != nil && !errors.Is(err, zk.ErrNoNode) {
+		return err
+	}
+
+	z.electionNode = ""
+	return nil
+}
+
+// ObserveLeader watches the children of the election znode, as any of them could become the lowest one
+func (z *ZooKeeper) ObserveLeader(ctx context.Context) <-chan string {
+	observer := make(chan string)
+	go func() {
+		defer close(observer)
+		lastLeaderID := ""
+		for {
+			_, _, event, err := z.conn.ChildrenW(z.keys.leader())
+			if err != nil {
+				z.Log.Warningf("stopped observing the election znode: %v", err)
+				return
+			}
+
+			leaderID, err := z.getLeaderID()
+			if err == nil && leaderID != lastLeaderID {
+				lastLeaderID = leaderID
+				if !notifyLeader(ctx, observer, leaderID) {
+					return
+				}
+			}
+
+			select {
+			case <-event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return observer
+}
+
+func (z *ZooKeeper) GetClusterKey(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := z.conn.Get(z.keys.cluster(key))
+	if errors.Is(err, zk.ErrNoNode) {
+		return nil, ErrKeyNotFound
+	}
+
+	return data, err
+}
+
+func (z *ZooKeeper) SetClusterKey(ctx context.Context, key string, value []byte) error {
+	if _, err := z.conn.Set(z.keys.cluster(key), value, -1); err == nil {
+		return nil
+	} else if !errors.Is(err, zk.ErrNoNode) {
+		return err
+	}
+
+	_, err := z.conn.Create(z.keys.cluster(key), value, 0, zk.WorldACL(zk.PermAll))
+	return err
+}
+
+func (z *ZooKeeper) DeleteClusterKey(ctx context.Context, key string) error {
+	if err := z.conn.Delete(z.keys.cluster(key), -1); err != nil && !errors.Is(err, zk.ErrNoNode) {
+		return err
+	}
+
+	return nil
+}
+
+func (z *ZooKeeper) Disconnect() error {
+	z.Log.Debugf("closing zookeeper session")
+	// Closing the session deletes every ephemeral znode created by this instance
+	z.conn.Close()
+	return nil
+}
+
+func (z *ZooKeeper) ensureElectionNode() error {
+	if z.electionNode != "" {
+		exists, _, err := z.conn.Exists(z.electionNode)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return nil
+		}
+	}
+
+	nodes, err := z.getElectionNodes()
+	if err != nil {
+		return err
+	}
+
+	return z.adoptElectionNode(nodes)
+}
+
+// adoptElectionNode takes over the election znode a promotion created for this instance, if any, otherwise it joins
+// the queue. A znode created by another session would outlive this instance, it is replaced with one of our own in
+// a single transaction, so that the instance never leaves the election
+func (z *ZooKeeper) adoptElectionNode(nodes []string) error {
+	for _, node := range nodes {
+		nodePath := path.Join(z.keys.leader(), node)
+		instanceID, stat, err := z.conn.Get(nodePath)
+		if errors.Is(err, zk.ErrNoNode) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if string(instanceID) != z.instanceID {
+			continue
+		}
+
+		if stat.EphemeralOwner == z.conn.SessionID() {
+			z.electionNode = nodePath
+			return nil
+		}
+
+		responses, err := z.conn.Multi(
+			&zk.CreateRequest{
+				Path:  path.Join(z.keys.leader(), electionNodePrefix),
+				Data:  []byte(z.instanceID),
+				Acl:   zk.WorldACL(zk.PermAll),
+				Flags: zk.FlagEphemeral | zk.FlagSequence,
+			},
+			&zk.DeleteRequest{Path: nodePath, Version: stat.Version},
+		)
+		if err != nil {
+			return err
+		}
+
+		z.electionNode = responses[0].String
+		return nil
+	}
+
+	return z.createElectionNode()
+}
+
+func (z *ZooKeeper) createElectionNode() error {
+	node, err := z.conn.Create(
+		path.Join(z.keys.leader(), electionNodePrefix),
+		[]byte(z.instanceID),
+		zk.FlagEphemeral|zk.FlagSequence,
+		zk.WorldACL(zk.PermAll),
+	)
+	if err != nil {
+		return err
+	}
+
+	z.electionNode = node
+	return nil
+}
+
+// getElectionNodes returns the election znodes sorted by their sequence number, the first one is the leader
+func (z *ZooKeeper) getElectionNodes() ([]string, error) {
+	nodes, _, err := z.conn.Children(z.keys.leader())
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return strings.TrimPrefix(nodes[i], electionNodePrefix) < strings.TrimPrefix(nodes[j], electionNodePrefix)
+	})
+
+	return nodes, nil
+}
+
+func (z *ZooKeeper) getLeaderID() (string, error) {
+	nodes, err := z.getElectionNodes()
+	if err != nil {
+		return "", err
+	}
+
+	if len(nodes) == 0 {
+		return "", fmt.Errorf("leader is not yet present in dcs")
+	}
+
+	leaderID, _, err := z.conn.Get(path.Join(z.keys.leader(), nodes[0]))
+	if err != nil {
+		return "", err
+	}
+
+	return string(leaderID), nil
+}
+
+func (z *ZooKeeper) getInstanceInfo(instanceID string) (InstanceInfo, error) {
+	data, _, err := z.conn.Get(path.Join(z.keys.members(), instanceID))
+	if errors.Is(err, zk.ErrNoNode) {
+		return InstanceInfo{}, fmt.Errorf("instance info with id %v not found", instanceID)
+	}
+	if err != nil {
+		return InstanceInfo{}, err
+	}
+
+	return unmarshalInstanceInfo(data)
+}
+
+// createPersistentPath creates every missing znode of the path, like mkdir -p
+func createPersistentPath(conn zkConn, p string) error {
+	current := ""
+	for _, part := range strings.Split(strings.Trim(p, "/"), "/") {
+		current = current + "/" + part
+		_, err := conn.Create(current, []byte{}, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && !errors.Is(err, zk.ErrNodeExists) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,614 @@
+package dcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MatteoGioioso/seeonethirtyseven/postgresql"
+	"github.com/go-zookeeper/zk"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeZooKeeper keeps the znodes in memory, with sessions, ephemeral and sequential znodes, one shot watches and
+// transactions: enough of a zookeeper ensemble for the dcs
+type fakeZooKeeper struct {
+	mu          sync.Mutex
+	nodes       map[string]*fakeZnode
+	sequences   map[string]int
+	watches     map[string][]chan zk.Event
+	lastSession int64
+}
+
+type fakeZnode struct {
+	data []byte
+	stat zk.Stat
+}
+
+func newFakeZooKeeper() *fakeZooKeeper {
+	return &fakeZooKeeper{
+		nodes:     map[string]*fakeZnode{"/": {}},
+		sequences: make(map[string]int),
+		watches:   make(map[string][]chan zk.Event),
+	}
+}
+
+// connect opens a new session
+func (f *fakeZooKeeper) connect() *fakeZkConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lastSession++
+	return &fakeZkConn{server: f, session: f.lastSession}
+}
+
+func (f *fakeZooKeeper) watch(key string) <-chan zk.Event {
+	event := make(chan zk.Event, 1)
+	f.watches[key] = append(f.watches[key], event)
+	return event
+}
+
+func (f *fakeZooKeeper) fire(key string, event zk.Event) {
+	for _, watch := range f.watches[key] {
+		watch <- event
+	}
+	delete(f.watches, key)
+}
+
+func (f *fakeZooKeeper) children(p string) []string {
+	children := make([]string, 0)
+	for nodePath := range f.nodes {
+		if nodePath != "/" && path.Dir(nodePath) == p {
+			children = append(children, path.Base(nodePath))
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+func (f *fakeZooKeeper) checkCreate(p string) error {
+	if _, ok := f.nodes[path.Dir(p)]; !ok {
+		return zk.ErrNoNode
+	}
+
+	return nil
+}
+
+func (f *fakeZooKeeper) create(p string, data []byte, flags int32, session int64) (string, error) {
+	if err := f.checkCreate(p); err != nil {
+		return "", err
+	}
+
+	parent := path.Dir(p)
+	if flags&zk.FlagSequence != 0 {
+		p = fmt.Sprintf("%v%010d", p, f.sequences[parent])
+		f.sequences[parent]++
+	}
+
+	if _, ok := f.nodes[p]; ok {
+		return "", zk.ErrNodeExists
+	}
+
+	node := &fakeZnode{data: data}
+	if flags&zk.FlagEphemeral != 0 {
+		node.stat.EphemeralOwner = session
+	}
+	f.nodes[p] = node
+
+	f.fire("exists:"+p, zk.Event{Type: zk.EventNodeCreated, Path: p})
+	f.fire("children:"+parent, zk.Event{Type: zk.EventNodeChildrenChanged, Path: parent})
+	return p, nil
+}
+
+func (f *fakeZooKeeper) checkDelete(p string, version int32) error {
+	node, ok := f.nodes[p]
+	if !ok {
+		return zk.ErrNoNode
+	}
+
+	if version != -1 && version != node.stat.Version {
+		return zk.ErrBadVersion
+	}
+
+	if len(f.children(p)) > 0 {
+		return zk.ErrNotEmpty
+	}
+
+	return nil
+}
+
+func (f *fakeZooKeeper) delete(p string) {
+	delete(f.nodes, p)
+	f.fire("exists:"+p, zk.Event{Type: zk.EventNodeDeleted, Path: p})
+	f.fire("children:"+path.Dir(p), zk.Event{Type: zk.EventNodeChildrenChanged, Path: path.Dir(p)})
+}
+
+// expire deletes every ephemeral znode of the session, like the ensemble does once the session is closed or expired
+func (f *fakeZooKeeper) expire(session int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for nodePath, node := range f.nodes {
+		if node.stat.EphemeralOwner == session {
+			f.delete(nodePath)
+		}
+	}
+}
+
+// electionInstances returns the instance ids in the election queue, in order
+func (f *fakeZooKeeper) electionInstances(k keyspace) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instanceIDs := make([]string, 0)
+	for _, node := range f.children(k.leader()) {
+		instanceIDs = append(instanceIDs, string(f.nodes[path.Join(k.leader(), node)].data))
+	}
+
+	return instanceIDs
+}
+
+type fakeZkConn struct {
+	server  *fakeZooKeeper
+	session int64
+}
+
+func (c *fakeZkConn) Create(p string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	return c.server.create(p, data, flags, c.session)
+}
+
+func (c *fakeZkConn) Set(p string, data []byte, version int32) (*zk.Stat, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	node, ok := c.server.nodes[p]
+	if !ok {
+		return nil, zk.ErrNoNode
+	}
+
+	if version != -1 && version != node.stat.Version {
+		return nil, zk.ErrBadVersion
+	}
+
+	node.data = data
+	node.stat.Version++
+	c.server.fire("exists:"+p, zk.Event{Type: zk.EventNodeDataChanged, Path: p})
+
+	stat := node.stat
+	return &stat, nil
+}
+
+func (c *fakeZkConn) Get(p string) ([]byte, *zk.Stat, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	node, ok := c.server.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+
+	stat := node.stat
+	return node.data, &stat, nil
+}
+
+func (c *fakeZkConn) Children(p string) ([]string, *zk.Stat, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	if _, ok := c.server.nodes[p]; !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+
+	return c.server.children(p), &zk.Stat{}, nil
+}
+
+func (c *fakeZkConn) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	if _, ok := c.server.nodes[p]; !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+
+	return c.server.children(p), &zk.Stat{}, c.server.watch("children:" + p), nil
+}
+
+func (c *fakeZkConn) Exists(p string) (bool, *zk.Stat, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	node, ok := c.server.nodes[p]
+	if !ok {
+		return false, nil, nil
+	}
+
+	stat := node.stat
+	return true, &stat, nil
+}
+
+func (c *fakeZkConn) ExistsW(p string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	event := c.server.watch("exists:" + p)
+	node, ok := c.server.nodes[p]
+	if !ok {
+		return false, nil, event, nil
+	}
+
+	stat := node.stat
+	return true, &stat, event, nil
+}
+
+func (c *fakeZkConn) Delete(p string, version int32) error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	if err := c.server.checkDelete(p, version); err != nil {
+		return err
+	}
+
+	c.server.delete(p)
+	return nil
+}
+
+// Multi checks every operation before applying any of them, the deletions are checked against the znodes as they are
+// before the transaction
+func (c *fakeZkConn) Multi(ops ...interface{}) ([]zk.MultiResponse, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	for _, op := range ops {
+		var err error
+		switch op := op.(type) {
+		case *zk.CreateRequest:
+			err = c.server.checkCreate(op.Path)
+		case *zk.DeleteRequest:
+			err = c.server.checkDelete(op.Path, op.Version)
+		default:
+			err = fmt.Errorf("unsupported operation %T", op)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	responses := make([]zk.MultiResponse, 0)
+	for _, op := range ops {
+		switch op := op.(type) {
+		case *zk.CreateRequest:
+			created, err := c.server.create(op.Path, op.Data, op.Flags, c.session)
+			responses = append(responses, zk.MultiResponse{String: created, Error: err})
+		case *zk.DeleteRequest:
+			c.server.delete(op.Path)
+			responses = append(responses, zk.MultiResponse{})
+		}
+	}
+
+	return responses, nil
+}
+
+func (c *fakeZkConn) SessionID() int64 {
+	return c.session
+}
+
+func (c *fakeZkConn) Close() {
+	c.server.expire(c.session)
+}
+
+func newTestZooKeeper(t *testing.T, server *fakeZooKeeper, instanceID string) *ZooKeeper {
+	t.Helper()
+
+	z := newZooKeeperWithConn(server.connect(), Config{
+		Hostname:    instanceID + "-host",
+		InstanceID:  instanceID,
+		Lease:       10,
+		Namespace:   "seeone",
+		ClusterName: "postgresql",
+	}, logrus.NewEntry(logrus.New()))
+	if err := z.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	return z
+}
+
+// waitForZooKeeperElection waits until the election queue is the expected one
+func waitForZooKeeperElection(t *testing.T, server *fakeZooKeeper, z *ZooKeeper, expected ...string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		instanceIDs := server.electionInstances(z.keys)
+		if strings.Join(instanceIDs, ",") == strings.Join(expected, ",") {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the election queue %v, got %v", expected, instanceIDs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestZooKeeperSaveAndListInstanceInfo(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeZooKeeper()
+	a := newTestZooKeeper(t, server, "a")
+	b := newTestZooKeeper(t, server, "b")
+
+	if err := a.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Leader}); err != nil {
+		t.Fatalf("SaveInstanceInfo: %v", err)
+	}
+	// The second save goes through the update path
+	if err := a.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Leader, Timeline: 2}); err != nil {
+		t.Fatalf("SaveInstanceInfo: %v", err)
+	}
+	if err := b.SaveInstanceInfo(ctx, InstanceInfo{Role: postgresql.Replica}); err != nil {
+		t.Fatalf("SaveInstanceInfo: %v", err)
+	}
+
+	instances, err := b.GetClusterInstancesInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetClusterInstancesInfo: %v", err)
+	}
+
+	got := make(map[string]InstanceInfo)
+	for _, instance := range instances {
+		got[instance.ID] = instance
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 instances, got %+v", instances)
+	}
+	if got["a"].Hostname != "a-host" || got["a"].Timeline != 2 || got["a"].Role != postgresql.Leader {
+		t.Errorf("unexpected instance a: %+v", got["a"])
+	}
+	if got["b"].Hostname != "b-host" || got["b"].Role != postgresql.Replica {
+		t.Errorf("unexpected instance b: %+v", got["b"])
+	}
+}
+
+func TestZooKeeperStartElection(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeZooKeeper()
+	a := newTestZooKeeper(t, server, "a")
+	b := newTestZooKeeper(t, server, "b")
+
+	if _, err := a.GetRole(ctx); err == nil {
+		t.Fatalf("expected an error without a leader")
+	}
+
+	if err := a.StartElection(ctx); err != nil {
+		t.Fatalf("StartElection: %v", err)
+	}
+	for _, z := range []*ZooKeeper{a, b} {
+		if err := z.SaveInstanceInfo(ctx, InstanceInfo{}); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+	}
+
+	elected := make(chan error, 1)
+	go func() { elected <- b.StartElection(ctx) }()
+
+	select {
+	case err := <-elected:
+		t.Fatalf("b was elected while a is the leader: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := a.Demote(ctx); err != nil {
+		t.Fatalf("Demote: %v", err)
+	}
+
+	select {
+	case err := <-elected:
+		if err != nil {
+			t.Fatalf("StartElection: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("b was not elected after a resigned")
+	}
+
+	leader, err := a.GetLeaderInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetLeaderInfo: %v", err)
+	}
+	if leader.ID != "b" || leader.Hostname != "b-host" {
+		t.Fatalf("unexpected leader %+v", leader)
+	}
+}
+
+func TestZooKeeperPromote(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeZooKeeper()
+	a := newTestZooKeeper(t, server, "a")
+	b := newTestZooKeeper(t, server, "b")
+	c := newTestZooKeeper(t, server, "c")
+
+	if err := a.StartElection(ctx); err != nil {
+		t.Fatalf("StartElection: %v", err)
+	}
+
+	// b joined the queue but is not campaigning anymore, like a replica waiting for its next cycle
+	bCtx, cancelB := context.WithCancel(ctx)
+	bElection := make(chan error, 1)
+	go func() { bElection <- b.StartElection(bCtx) }()
+	waitForZooKeeperElection(t, server, a, "a", "b")
+	cancelB()
+	<-bElection
+
+	cElection := make(chan error, 1)
+	go func() { cElection <- c.StartElection(ctx) }()
+	waitForZooKeeperElection(t, server, a, "a", "b", "c")
+
+	if err := a.Promote(ctx, "unknown"); err == nil {
+		t.Fatalf("expected an error promoting an instance which is not campaigning")
+	}
+
+	if err := a.Promote(ctx, "c"); err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+
+	select {
+	case err := <-cElection:
+		if err != nil {
+			t.Fatalf("StartElection: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("c was not elected after the promotion")
+	}
+
+	// The instances handing over and the ones in between keep their place in the election
+	waitForZooKeeperElection(t, server, a, "c", "a", "b")
+	for z, expected := range map[*ZooKeeper]string{a: postgresql.Replica, b: postgresql.Replica, c: postgresql.Leader} {
+		role, err := z.GetRole(ctx)
+		if err != nil {
+			t.Fatalf("GetRole: %v", err)
+		}
+		if role != expected {
+			t.Errorf("instance %v: expected role %v, got %v", z.instanceID, expected, role)
+		}
+	}
+
+	// b campaigning again takes over the znode created on its behalf, which would otherwise go away with a
+	go b.StartElection(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		nodes, err := b.getElectionNodes()
+		if err != nil {
+			t.Fatalf("getElectionNodes: %v", err)
+		}
+
+		adopted := false
+		for _, node := range nodes {
+			instanceID, stat, err := b.conn.Get(path.Join(b.keys.leader(), node))
+			if err == nil && string(instanceID) == "b" && stat.EphemeralOwner == b.conn.SessionID() {
+				adopted = true
+			}
+		}
+
+		if adopted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("b did not take over its election znode")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForZooKeeperElection(t, server, a, "c", "a", "b")
+
+	if err := a.Disconnect(); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+	waitForZooKeeperElection(t, server, a, "c", "b")
+}
+
+func TestZooKeeperObserveLeader(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeZooKeeper()
+	a := newTestZooKeeper(t, server, "a")
+	b := newTestZooKeeper(t, server, "b")
+
+	observerCtx, cancelObserver := context.WithCancel(ctx)
+	defer cancelObserver()
+	observer := b.ObserveLeader(observerCtx)
+
+	expectLeader := func(expected string) {
+		t.Helper()
+		select {
+		case leaderID := <-observer:
+			if leaderID != expected {
+				t.Fatalf("expected to observe leader %v, got %v", expected, leaderID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("leader %v was not observed", expected)
+		}
+	}
+
+	if err := a.StartElection(ctx); err != nil {
+		t.Fatalf("StartElection: %v", err)
+	}
+	expectLeader("a")
+
+	go b.StartElection(ctx)
+	waitForZooKeeperElection(t, server, a, "a", "b")
+
+	// The session of the leader expires, its znode goes away with it
+	server.expire(a.conn.SessionID())
+	expectLeader("b")
+}
+
+func TestZooKeeperDisconnect(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeZooKeeper()
+	a := newTestZooKeeper(t, server, "a")
+	b := newTestZooKeeper(t, server, "b")
+
+	if err := a.StartElection(ctx); err != nil {
+		t.Fatalf("StartElection: %v", err)
+	}
+	for _, z := range []*ZooKeeper{a, b} {
+		if err := z.SaveInstanceInfo(ctx, InstanceInfo{}); err != nil {
+			t.Fatalf("SaveInstanceInfo: %v", err)
+		}
+	}
+
+	if err := a.Disconnect(); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+
+	instances, err := b.GetClusterInstancesInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetClusterInstancesInfo: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ID != "b" {
+		t.Fatalf("expected only instance b, got %+v", instances)
+	}
+
+	if _, err := b.GetRole(ctx); err == nil {
+		t.Fatalf("expected no leader once the leader session is closed")
+	}
+}
+
+func TestZooKeeperClusterKeys(t *testing.T) {
+	ctx := context.Background()
+	z := newTestZooKeeper(t, newFakeZooKeeper(), "a")
+
+	if _, err := z.GetClusterKey(ctx, "config"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	for _, value := range []string{"first", "second"} {
+		if err := z.SetClusterKey(ctx, "config", []byte(value)); err != nil {
+			t.Fatalf("SetClusterKey: %v", err)
+		}
+
+		got, err := z.GetClusterKey(ctx, "config")
+		if err != nil {
+			t.Fatalf("GetClusterKey: %v", err)
+		}
+		if string(got) != value {
+			t.Errorf("expected %v, got %v", value, string(got))
+		}
+	}
+
+	if err := z.DeleteClusterKey(ctx, "config"); err != nil {
+		t.Fatalf("DeleteClusterKey: %v", err)
+	}
+	if err := z.DeleteClusterKey(ctx, "config"); err != nil {
+		t.Fatalf("DeleteClusterKey of a missing key: %v", err)
+	}
+	if _, err := z.GetClusterKey(ctx, "config"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
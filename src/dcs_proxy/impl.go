@@ -24,12 +24,15 @@ type ProxyImpl struct {
 	postmaster postgresql.Postmaster
 	cb         *gobreaker.CircuitBreaker
 	log        *logrus.Entry
+	// noFailover is set for members tagged nofailover, they never take part in the election
+	noFailover bool
 }
 
-func New(dcsClient dcs.DCS, postmaster postgresql.Postmaster, log *logrus.Entry) ProxyImpl {
+func New(dcsClient dcs.DCS, postmaster postgresql.Postmaster, noFailover bool, log *logrus.Entry) ProxyImpl {
 	return ProxyImpl{
 		dcsClient:  dcsClient,
 		postmaster: postmaster,
+		noFailover: noFailover,
 		log:        log,
 	}
 }
@@ -42,7 +45,7 @@ func (p *ProxyImpl) Connect(ctx context.Context) error {
 			// as the old one won't be running anymore
 			// TODO check is this can cause split-brain
 			if from == gobreaker.StateHalfOpen && to == gobreaker.StateClosed {
-				go p.dcsClient.StartElection(ctx)
+				p.StartElection(ctx)
 			}
 		},
 	})
@@ -63,6 +66,11 @@ func (p *ProxyImpl) Connect(ctx context.Context) error {
 }
 
 func (p *ProxyImpl) StartElection(ctx context.Context) {
+	if p.noFailover {
+		p.log.Debugf("member is tagged not to fail over, not taking part in the election")
+		return
+	}
+
 	go p.dcsClient.StartElection(ctx)
 }
 
@@ -128,15 +136,107 @@ func (p *ProxyImpl) GetLeaderInfo(ctx context.Context) (dcs.InstanceInfo, error)
 	return instanceInfo, err
 }
 
-func (p *ProxyImpl) SaveInstanceInfo(ctx context.Context, role string) error {
+func (p *ProxyImpl) SaveInstanceInfo(ctx context.Context, info dcs.InstanceInfo) error {
 	_, err := p.cb.Execute(func() (interface{}, error) {
-		return nil, p.dcsClient.SaveInstanceInfo(ctx, role)
+		return nil, p.dcsClient.SaveInstanceInfo(ctx, info)
 	})
 
 	p.log.Debugf("instance info saved")
 	return err
 }
 
+func (p *ProxyImpl) GetSyncState(ctx context.Context) (dcs.SyncState, error) {
+	syncState, err := p.cb.Execute(func() (interface{}, error) {
+		return dcs.GetSyncState(ctx, p.dcsClient)
+	})
+	if err != nil {
+		return dcs.SyncState{}, err
+	}
+
+	return syncState.(dcs.SyncState), nil
+}
+
+func (p *ProxyImpl) SaveSyncState(ctx context.Context, syncState dcs.SyncState) error {
+	_, err := p.cb.Execute(func() (interface{}, error) {
+		return nil, dcs.SaveSyncState(ctx, p.dcsClient, syncState)
+	})
+
+	return err
+}
+
+func (p *ProxyImpl) GetClusterConfig(ctx context.Context) (dcs.ClusterConfig, error) {
+	clusterConfig, err := p.cb.Execute(func() (interface{}, error) {
+		return dcs.GetClusterConfig(ctx, p.dcsClient)
+	})
+	if err != nil {
+		return dcs.ClusterConfig{}, err
+	}
+
+	return clusterConfig.(dcs.ClusterConfig), nil
+}
+
+func (p *ProxyImpl) SaveClusterConfig(ctx context.Context, clusterConfig dcs.ClusterConfig) error {
+	_, err := p.cb.Execute(func() (interface{}, error) {
+		return nil, dcs.SaveClusterConfig(ctx, p.dcsClient, clusterConfig)
+	})
+
+	return err
+}
+
+func (p *ProxyImpl) GetFailover(ctx context.Context) (*dcs.Failover, error) {
+	failover, err := p.cb.Execute(func() (interface{}, error) {
+		return dcs.GetFailover(ctx, p.dcsClient)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return failover.(*dcs.Failover), nil
+}
+
+func (p *ProxyImpl) SaveFailover(ctx context.Context, failover dcs.Failover) error {
+	_, err := p.cb.Execute(func() (interface{}, error) {
+		return nil, dcs.SaveFailover(ctx, p.dcsClient, failover)
+	})
+
+	return err
+}
+
+func (p *ProxyImpl) DeleteFailover(ctx context.Context) error {
+	_, err := p.cb.Execute(func() (interface{}, error) {
+		return nil, dcs.DeleteFailover(ctx, p.dcsClient)
+	})
+
+	return err
+}
+
+func (p *ProxyImpl) GetPause(ctx context.Context) (*dcs.Pause, error) {
+	pause, err := p.cb.Execute(func() (interface{}, error) {
+		return dcs.GetPause(ctx, p.dcsClient)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pause.(*dcs.Pause), nil
+}
+
+func (p *ProxyImpl) SavePause(ctx context.Context, pause dcs.Pause) error {
+	_, err := p.cb.Execute(func() (interface{}, error) {
+		return nil, dcs.SavePause(ctx, p.dcsClient, pause)
+	})
+
+	return err
+}
+
+func (p *ProxyImpl) DeletePause(ctx context.Context) error {
+	_, err := p.cb.Execute(func() (interface{}, error) {
+		return nil, dcs.DeletePause(ctx, p.dcsClient)
+	})
+
+	return err
+}
+
 func (p *ProxyImpl) Promote(ctx context.Context, instanceID string) error {
 	return p.dcsClient.Promote(ctx, instanceID)
 }
@@ -145,6 +245,12 @@ func (p *ProxyImpl) GetClusterInstances(ctx context.Context) ([]dcs.InstanceInfo
 	return p.dcsClient.GetClusterInstancesInfo(ctx)
 }
 
+// ObserveLeader is not protected by the circuit breaker: a broken watch simply closes the channel and the daemon
+// falls back to its ticker
+func (p *ProxyImpl) ObserveLeader(ctx context.Context) <-chan string {
+	return p.dcsClient.ObserveLeader(ctx)
+}
+
 func (p *ProxyImpl) Disconnect() error {
 	return p.dcsClient.Disconnect()
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/MatteoGioioso/seeonethirtyseven/api"
 	"github.com/MatteoGioioso/seeonethirtyseven/daemon"
 	"github.com/MatteoGioioso/seeonethirtyseven/dcs"
@@ -23,8 +25,22 @@ var (
 	pgUser                  = kingpin.Flag("pguser", "").Default("postgres").Envar("PGUSER").String()
 	hostname                = kingpin.Flag("hostname", "").Required().Envar("HOSTNAME").String()
 	replicationUserPassword = kingpin.Flag("pgreplication-user-password", "").Required().Envar("PGREPLICATION_PASSWORD").String()
-	etcdCluster             = kingpin.Flag("etcd-cluster", "").Required().Envar("ETCD_CLUSTER").String()
+	dcsType                 = kingpin.Flag("dcs-type", fmt.Sprintf("dcs provider, one of: %v", strings.Join(dcs.Providers(), ", "))).Envar("DCS_TYPE").Default("etcd").String()
+	etcdCluster             = kingpin.Flag("etcd-cluster", "space separated etcd endpoints").Envar("ETCD_CLUSTER").String()
+	kubernetesNamespace     = kingpin.Flag("kubernetes-namespace", "").Envar("KUBERNETES_NAMESPACE").Default("default").String()
+	consulAddress           = kingpin.Flag("consul-address", "").Envar("CONSUL_HTTP_ADDR").String()
+	zookeeperServers        = kingpin.Flag("zookeeper-servers", "space separated zookeeper servers").Envar("ZOOKEEPER_SERVERS").String()
+	namespace               = kingpin.Flag("namespace", "dcs namespace, prefix of every cluster key").Envar("SEEONE_NAMESPACE").Default("seeone").String()
+	clusterName             = kingpin.Flag("cluster-name", "name of the cluster, prefixed by the namespace in every dcs key").Envar("CLUSTER_NAME").Default("postgresql").String()
 	leaderLease             = kingpin.Flag("leader-lease", "").Envar("LEADER_LEASE").Default("10").Int()
+	loopWait                = kingpin.Flag("loop-wait", "seconds between daemon loop runs when no leadership change is observed").Envar("LOOP_WAIT").Default("10").Int()
+	maximumLagOnFailover    = kingpin.Flag("maximum-lag-on-failover", "bytes of WAL a replica can be behind the former leader and still be promoted").Envar("MAXIMUM_LAG_ON_FAILOVER").Default("1048576").Int64()
+	synchronousMode         = kingpin.Flag("synchronous-mode", "off, on: commits wait for the first synchronous-node-count standbys, quorum: commits wait for any synchronous-node-count standbys").Envar("SYNCHRONOUS_MODE").Default("off").Enum("off", "on", "quorum")
+	synchronousNodeCount    = kingpin.Flag("synchronous-node-count", "number of synchronous standbys").Envar("SYNCHRONOUS_NODE_COUNT").Default("1").Int()
+	synchronousModeStrict   = kingpin.Flag("synchronous-mode-strict", "block commits when no synchronous standby is available, instead of falling back to asynchronous replication").Envar("SYNCHRONOUS_MODE_STRICT").Default("false").Bool()
+	localConfig             = kingpin.Flag("local-config", "json file overriding the cluster config for this node only").Envar("SEEONE_LOCAL_CONFIG").String()
+	apiPort                 = kingpin.Flag("api-port", "").Envar("API_PORT").Default("8080").String()
+	tags                    = kingpin.Flag("tags", "space separated key=value tags published with the instance info, nofailover, noloadbalance, clonefrom, replicatefrom, failover_priority and recovery_min_apply_delay are honoured").Envar("SEEONE_TAGS").String()
 	logLevel                = kingpin.Flag("log-level", "").Envar("LOG_LEVEL").Default("info").Enum("info", "debug", "warning")
 
 	log *logrus.Entry
@@ -44,49 +60,108 @@ func main() {
 		log.Debugf("%v, retrying: %v/%v", err, n, retry.DefaultAttempts)
 	}
 
+	instanceTags, err := parseTags(*tags)
+	if err != nil {
+		log.Fatalf("could not parse tags: %v", err)
+	}
+
 	pgConfig := postgresql.Config{
-		DataDir:             *pgDataFolder,
-		ExtraDir:            *extraFolder,
-		ReplicationUsername: "replicator",
-		ReplicationPassword: *replicationUserPassword,
-		AdminUsername:       *pgUser,
-		AdminPassword:       *pgPassword,
-		InstanceID:          instanceID.String(),
+		DataDir:               *pgDataFolder,
+		ExtraDir:              *extraFolder,
+		ReplicationUsername:   "replicator",
+		ReplicationPassword:   *replicationUserPassword,
+		AdminUsername:         *pgUser,
+		AdminPassword:         *pgPassword,
+		InstanceID:            instanceID.String(),
+		Hostname:              *hostname,
+		RecoveryMinApplyDelay: instanceTags.RecoveryMinApplyDelay(),
 	}
 
 	postmaster := postgresql.NewPostmaster(pgConfig, log)
 
-	factory := dcs.NewFactory(
-		strings.Split(*etcdCluster, " "),
-		dcs.Config{
-			Hostname:   *hostname,
-			InstanceID: instanceID.String(),
-			Lease:      *leaderLease,
-		},
-		log,
-	)
-	dcsClient := factory.Get("etcd")
-	dcsProxy := dcs_proxy.New(dcsClient, postmaster, log)
+	if *synchronousNodeCount < 1 {
+		log.Fatalf("synchronous node count must be at least 1, got %v", *synchronousNodeCount)
+	}
+
+	if *synchronousModeStrict && *synchronousMode == daemon.SynchronousModeOff {
+		log.Fatalf("synchronous mode strict requires the synchronous mode to be on or quorum")
+	}
+
+	localClusterConfig, err := loadLocalConfig(*localConfig)
+	if err != nil {
+		log.Fatalf("could not load local config: %v", err)
+	}
+
+	dcsOptions := dcs.Options{
+		Etcd:       dcs.EtcdOptions{Endpoints: strings.Fields(*etcdCluster)},
+		Kubernetes: dcs.KubernetesOptions{Namespace: *kubernetesNamespace},
+		Consul:     dcs.ConsulOptions{Address: *consulAddress},
+		ZooKeeper:  dcs.ZooKeeperOptions{Servers: strings.Fields(*zookeeperServers)},
+	}
+	dcsConfig := dcs.Config{
+		Hostname:    *hostname,
+		InstanceID:  instanceID.String(),
+		Lease:       *leaderLease,
+		Namespace:   *namespace,
+		ClusterName: *clusterName,
+	}
+
+	lease, err := resolveLease(ctx, dcs.NewFactory(dcsOptions, dcsConfig, log), localClusterConfig)
+	if err != nil {
+		log.Fatalf("could not read the ttl from the cluster config: %v", err)
+	}
+	dcsConfig.Lease = lease
+
+	factory := dcs.NewFactory(dcsOptions, dcsConfig, log)
+	dcsClient, err := factory.Get(*dcsType)
+	if err != nil {
+		log.Fatalf("could not create dcs client: %v", err)
+	}
+
+	dcsProxy := dcs_proxy.New(dcsClient, postmaster, instanceTags.NoFailover(), log)
 	if err := dcsProxy.Connect(ctx); err != nil {
 		log.Fatal(err)
 	}
 
 	dcsProxy.StartElection(ctx)
 
+	stateMachine := daemon.NewStateMachine(log)
+	restarts := daemon.NewRestartScheduler()
+
 	a := api.Api{
 		Postmaster: postmaster,
 		DcsProxy:   dcsProxy,
+		State:      stateMachine,
+		Restarts:   restarts,
 		Log:        log,
-		Config:     api.Config{Port: "8080", InstanceID: instanceID.String()},
-		QuitChan:   quit,
+		Config: api.Config{
+			Port:        *apiPort,
+			InstanceID:  instanceID.String(),
+			LocalConfig: localClusterConfig,
+			Tags:        instanceTags,
+		},
+		QuitChan: quit,
 	}
 
 	d := daemon.Daemon{
-		PgConfig:   pgConfig,
-		Postmaster: postmaster,
-		DcsProxy:   dcsProxy,
-		Log:        log,
-		Config:     daemon.Config{TickDuration: 10},
+		PgConfig:    pgConfig,
+		Postmaster:  postmaster,
+		DcsProxy:    dcsProxy,
+		State:       stateMachine,
+		Restarts:    restarts,
+		Log:         log,
+		LocalConfig: localClusterConfig,
+		Config: daemon.Config{
+			TickDuration:          *loopWait,
+			Hostname:              *hostname,
+			Lease:                 lease,
+			MaximumLagOnFailover:  *maximumLagOnFailover,
+			APIURL:                fmt.Sprintf("http://%v:%v", *hostname, *apiPort),
+			Tags:                  instanceTags,
+			SynchronousMode:       *synchronousMode,
+			SynchronousNodeCount:  *synchronousNodeCount,
+			SynchronousModeStrict: *synchronousModeStrict,
+		},
 	}
 
 	go a.Start(ctx)
@@ -119,3 +194,72 @@ func main() {
 		os.Exit(0)
 	}
 }
+
+// parseTags parses space separated key=value pairs
+func parseTags(s string) (dcs.Tags, error) {
+	tags := make(dcs.Tags)
+	for _, field := range strings.Fields(s) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag %q, expected key=value", field)
+		}
+
+		tags[parts[0]] = parts[1]
+	}
+
+	return tags, tags.Validate()
+}
+
+// resolveLease returns the ttl of the cluster config, with the node overrides, falling back to the leader lease flag.
+// The lease is granted when connecting to the dcs, so the cluster config is read with a short lived client first
+func resolveLease(ctx context.Context, factory *dcs.Factory, localClusterConfig dcs.ClusterConfig) (int, error) {
+	dcsClient, err := factory.Get(*dcsType)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := retry.Do(
+		func() error {
+			return dcsClient.Connect(ctx)
+		},
+		retry.Attempts(5),
+	); err != nil {
+		return 0, fmt.Errorf("could not connect to dcs: %v", err)
+	}
+	defer func() {
+		if err := dcsClient.Disconnect(); err != nil {
+			log.Warningf("could not disconnect the dcs client used to read the cluster config: %v", err)
+		}
+	}()
+
+	clusterConfig, err := dcs.GetClusterConfig(ctx, dcsClient)
+	if err != nil {
+		return 0, err
+	}
+
+	if ttl := clusterConfig.Merge(localClusterConfig).TTL; ttl != 0 {
+		log.Infof("using ttl %v from the cluster config", ttl)
+		return ttl, nil
+	}
+
+	return *leaderLease, nil
+}
+
+// loadLocalConfig reads the node overrides of the cluster config, no file means no overrides
+func loadLocalConfig(filename string) (dcs.ClusterConfig, error) {
+	if filename == "" {
+		return dcs.ClusterConfig{}, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return dcs.ClusterConfig{}, err
+	}
+
+	var clusterConfig dcs.ClusterConfig
+	if err := json.Unmarshal(data, &clusterConfig); err != nil {
+		return dcs.ClusterConfig{}, err
+	}
+
+	return clusterConfig, clusterConfig.Validate()
+}
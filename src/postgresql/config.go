@@ -8,8 +8,19 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"time"
 )
 
+// managedParameters are set by seeone itself and cannot be overridden from the cluster config
+var managedParameters = map[string]bool{
+	"primary_conninfo":          true,
+	"primary_slot_name":         true,
+	"recovery_min_apply_delay":  true,
+	"synchronous_standby_names": true,
+}
+
 type Config struct {
 	DataDir             string
 	ExtraDir            string
@@ -19,6 +30,12 @@ type Config struct {
 	AdminPassword       string
 	Port                string
 	InstanceID          string
+	// Hostname names the replication slot and the application_name of the instance, the other members know it by it
+	Hostname string
+	// Parameters come from the cluster config, they are written after the template ones
+	Parameters map[string]string
+	// RecoveryMinApplyDelay makes a delayed replica, it comes from the member tags
+	RecoveryMinApplyDelay time.Duration
 
 	role string
 }
@@ -42,30 +59,88 @@ func (c *Config) CreateHBA() error {
 }
 
 func (c *Config) CreateConfig(leaderHostname string) error {
-	file, err := ioutil.ReadFile(path.Join(c.ExtraDir, "postgresql.template.conf"))
+	pgConf, err := c.renderConfig(leaderHostname)
 	if err != nil {
 		return err
 	}
 
+	if err := ioutil.WriteFile(c.getConfigPath(), pgConf, 0700); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateConfig writes postgresql.conf only if its content changed, it reports if postgres must reload it
+func (c *Config) UpdateConfig(leaderHostname string) (bool, error) {
+	pgConf, err := c.renderConfig(leaderHostname)
+	if err != nil {
+		return false, err
+	}
+
+	current, err := ioutil.ReadFile(c.getConfigPath())
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if bytes.Equal(current, pgConf) {
+		return false, nil
+	}
+
+	if err := ioutil.WriteFile(c.getConfigPath(), pgConf, 0700); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (c *Config) renderConfig(leaderHostname string) ([]byte, error) {
+	file, err := ioutil.ReadFile(path.Join(c.ExtraDir, "postgresql.template.conf"))
+	if err != nil {
+		return nil, err
+	}
+
 	pgConf := bytes.NewBuffer(file)
+	pgConf.WriteString("\n")
 	// If we are using replication slots and the replica goes down for long time, the leader might accumulate an infinite
 	// amount of WAL files. To prevent this we set max_slot_wal_keep_size
 	pgConf.WriteString("max_slot_wal_keep_size = 40GB")
 	pgConf.WriteString("\n")
+
+	names := make([]string, 0, len(c.Parameters))
+	for name := range c.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if managedParameters[name] {
+			continue
+		}
+
+		pgConf.WriteString(fmt.Sprintf("%v = '%v'\n", name, strings.ReplaceAll(c.Parameters[name], "'", "''")))
+	}
+
 	pgConf.WriteString(fmt.Sprintf(
-		"primary_conninfo = 'user=%v password=%v host=%v port=5432 sslmode=prefer sslcompression=0'",
+		"primary_conninfo = 'user=%v password=%v host=%v port=5432 sslmode=prefer sslcompression=0 application_name=%v'",
 		c.ReplicationUsername,
 		c.ReplicationPassword,
 		leaderHostname,
+		// The leader lists its synchronous standbys by application name
+		c.Hostname,
 	))
 	pgConf.WriteString("\n")
-	pgConf.WriteString(fmt.Sprintf("primary_slot_name = '%v'", os.Getenv("HOSTNAME")))
-
-	if err := ioutil.WriteFile(path.Join(c.DataDir, "postgresql.conf"), pgConf.Bytes(), 0700); err != nil {
-		return err
+	pgConf.WriteString(fmt.Sprintf("primary_slot_name = '%v'", c.Hostname))
+	if c.RecoveryMinApplyDelay > 0 {
+		// It is ignored by the leader, so there is no need to know the role
+		pgConf.WriteString("\n")
+		pgConf.WriteString(fmt.Sprintf("recovery_min_apply_delay = '%vms'", c.RecoveryMinApplyDelay.Milliseconds()))
 	}
 
-	return nil
+	return pgConf.Bytes(), nil
+}
+
+func (c *Config) getConfigPath() string {
+	return path.Join(c.DataDir, "postgresql.conf")
 }
 
 func (c *Config) CreateReplicationUser(ctx context.Context, conn *pgx.Conn) error {
@@ -0,0 +1,48 @@
+package postgresql
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRenderConfig(t *testing.T) {
+	extraDir := t.TempDir()
+	if err := os.WriteFile(path.Join(extraDir, "postgresql.template.conf"), []byte("listen_addresses = '*'"), 0600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+
+	config := Config{
+		ExtraDir:            extraDir,
+		ReplicationUsername: "replicator",
+		ReplicationPassword: "secret",
+		Hostname:            "replica-1",
+		Parameters: map[string]string{
+			"work_mem":          "8MB",
+			"primary_slot_name": "overridden",
+		},
+	}
+
+	rendered, err := config.renderConfig("leader-1")
+	if err != nil {
+		t.Fatalf("renderConfig: %v", err)
+	}
+
+	pgConf := string(rendered)
+	for _, expected := range []string{
+		"listen_addresses = '*'",
+		"work_mem = '8MB'",
+		"host=leader-1 ",
+		"application_name=replica-1'",
+		"primary_slot_name = 'replica-1'",
+	} {
+		if !strings.Contains(pgConf, expected) {
+			t.Errorf("expected %q in:\n%v", expected, pgConf)
+		}
+	}
+
+	if strings.Contains(pgConf, "overridden") {
+		t.Errorf("a managed parameter was overridden:\n%v", pgConf)
+	}
+}
@@ -1,11 +1,13 @@
 package postgresql
 
 const (
-	Leader               = "leader"
-	Replica              = "replica"
-	LeaderElectionPrefix = "/postgresql-leader"
-	InstanceInfoPrefix   = "/postgresql-info"
-	ReplicationSlot      = "replication"
+	Leader          = "leader"
+	Replica         = "replica"
+	ReplicationSlot = "replication"
+
+	PostgresStateRunning  = "running"
+	PostgresStateStarting = "starting"
+	PostgresStateStopped  = "stopped"
 
 	StopModeSmart     = "smart"     // disallows new connections, then waits for all existing clients to disconnect
 	StopModeFast      = "fast"      // (the default) does not wait for clients to disconnect. All active transactions are rolled back and clients are forcibly disconnected
@@ -0,0 +1,73 @@
+package postgresql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	clusterStateKey = "Database cluster state"
+	timelineKey     = "Latest checkpoint's TimeLineID"
+	checkpointKey   = "Latest checkpoint location"
+
+	ClusterStateShutDown           = "shut down"
+	ClusterStateShutDownInRecovery = "shut down in recovery"
+	ClusterStateInProduction       = "in production"
+	ClusterStateInArchiveRecovery  = "in archive recovery"
+
+	standbySignalFile = "standby.signal"
+)
+
+// ControlData holds the pg_controldata output, indexed by label
+type ControlData map[string]string
+
+func parseControlData(out string) ControlData {
+	controlData := make(ControlData)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		controlData[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return controlData
+}
+
+func (c ControlData) ClusterState() string {
+	return c[clusterStateKey]
+}
+
+func (c ControlData) Timeline() (int, error) {
+	timeline, err := strconv.Atoi(c[timelineKey])
+	if err != nil {
+		return 0, fmt.Errorf("could not parse timeline from pg_controldata: %v", err)
+	}
+
+	return timeline, nil
+}
+
+// CheckpointLSN is the position of the last checkpoint record, after a clean shutdown it is the shutdown checkpoint
+func (c ControlData) CheckpointLSN() (LSN, error) {
+	lsn, err := ParseLSN(c[checkpointKey])
+	if err != nil {
+		return 0, fmt.Errorf("could not parse checkpoint location from pg_controldata: %v", err)
+	}
+
+	return lsn, nil
+}
+
+// WasLeader tells if the data directory was last used by a postgres running as leader, either shut down cleanly or not
+func (c ControlData) WasLeader() bool {
+	state := c.ClusterState()
+	return state == ClusterStateShutDown || state == ClusterStateInProduction
+}
+
+// WasReplica tells if the data directory was last used by a postgres running in recovery mode, either shut down cleanly
+// or not
+func (c ControlData) WasReplica() bool {
+	state := c.ClusterState()
+	return state == ClusterStateShutDownInRecovery || state == ClusterStateInArchiveRecovery
+}
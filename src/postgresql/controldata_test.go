@@ -0,0 +1,83 @@
+package postgresql
+
+import "testing"
+
+const controlDataOutput = `pg_control version number:            1300
+Catalog version number:               202107181
+Database system identifier:           7154346424637874215
+Database cluster state:               shut down
+pg_control last modified:             Mon 17 Oct 2022 10:00:00 AM UTC
+Latest checkpoint location:           0/3000028
+Latest checkpoint's REDO location:    0/3000028
+Latest checkpoint's REDO WAL file:    000000020000000000000003
+Latest checkpoint's TimeLineID:       2
+Latest checkpoint's PrevTimeLineID:   2
+Time of latest checkpoint:            Mon 17 Oct 2022 10:00:00 AM UTC
+`
+
+func TestParseControlData(t *testing.T) {
+	controlData := parseControlData(controlDataOutput)
+
+	if controlData.ClusterState() != ClusterStateShutDown {
+		t.Errorf("expected cluster state %q, got %q", ClusterStateShutDown, controlData.ClusterState())
+	}
+
+	// The value contains a colon, only the first one separates the label
+	if got := controlData["Time of latest checkpoint"]; got != "Mon 17 Oct 2022 10:00:00 AM UTC" {
+		t.Errorf("unexpected time of latest checkpoint %q", got)
+	}
+
+	timeline, err := controlData.Timeline()
+	if err != nil {
+		t.Fatalf("Timeline: %v", err)
+	}
+	if timeline != 2 {
+		t.Errorf("expected timeline 2, got %v", timeline)
+	}
+
+	checkpoint, err := controlData.CheckpointLSN()
+	if err != nil {
+		t.Fatalf("CheckpointLSN: %v", err)
+	}
+	if checkpoint != 0x3000028 {
+		t.Errorf("expected checkpoint 0/3000028, got %v", checkpoint)
+	}
+}
+
+func TestControlDataMissingFields(t *testing.T) {
+	controlData := parseControlData("garbage\n")
+
+	if _, err := controlData.Timeline(); err == nil {
+		t.Errorf("expected an error without timeline")
+	}
+	if _, err := controlData.CheckpointLSN(); err == nil {
+		t.Errorf("expected an error without checkpoint location")
+	}
+	if controlData.WasLeader() || controlData.WasReplica() {
+		t.Errorf("an unknown cluster state is neither leader nor replica")
+	}
+}
+
+func TestControlDataRole(t *testing.T) {
+	tests := []struct {
+		state      string
+		wasLeader  bool
+		wasReplica bool
+	}{
+		{state: ClusterStateShutDown, wasLeader: true},
+		{state: ClusterStateInProduction, wasLeader: true},
+		{state: ClusterStateShutDownInRecovery, wasReplica: true},
+		{state: ClusterStateInArchiveRecovery, wasReplica: true},
+		{state: "starting up"},
+	}
+
+	for _, tt := range tests {
+		controlData := ControlData{clusterStateKey: tt.state}
+		if controlData.WasLeader() != tt.wasLeader || controlData.WasReplica() != tt.wasReplica {
+			t.Errorf(
+				"state %q: WasLeader = %v, WasReplica = %v, want %v, %v",
+				tt.state, controlData.WasLeader(), controlData.WasReplica(), tt.wasLeader, tt.wasReplica,
+			)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package postgresql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LSN is a position in the WAL, postgres prints it as two hexadecimal numbers separated by a slash: 16/B374D848
+type LSN uint64
+
+func ParseLSN(s string) (LSN, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid lsn %q", s)
+	}
+
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lsn %q: %v", s, err)
+	}
+
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lsn %q: %v", s, err)
+	}
+
+	return LSN(hi<<32 | lo), nil
+}
+
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint32(l>>32), uint32(l))
+}
+
+// Diff returns the number of bytes of WAL between the two positions, zero if other is ahead
+func (l LSN) Diff(other LSN) int64 {
+	if other >= l {
+		return 0
+	}
+
+	return int64(l - other)
+}
+
+func (l LSN) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *LSN) UnmarshalText(text []byte) error {
+	lsn, err := ParseLSN(string(text))
+	if err != nil {
+		return err
+	}
+
+	*l = lsn
+	return nil
+}
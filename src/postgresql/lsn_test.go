@@ -0,0 +1,80 @@
+package postgresql
+
+import "testing"
+
+func TestParseLSN(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    LSN
+		wantErr bool
+	}{
+		{in: "0/0", want: 0},
+		{in: "0/16B3748", want: 0x16B3748},
+		{in: "16/B374D848", want: 0x16<<32 | 0xB374D848},
+		{in: "FFFFFFFF/FFFFFFFF", want: LSN(^uint64(0))},
+		{in: "", wantErr: true},
+		{in: "16B374D848", wantErr: true},
+		{in: "16/B374D848/0", wantErr: true},
+		{in: "G/0", wantErr: true},
+		{in: "100000000/0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLSN(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseLSN(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseLSN(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseLSN(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if got.String() != tt.in {
+			t.Errorf("ParseLSN(%q).String() = %v", tt.in, got.String())
+		}
+	}
+}
+
+func TestLSNDiff(t *testing.T) {
+	tests := []struct {
+		l, other LSN
+		want     int64
+	}{
+		{l: 100, other: 40, want: 60},
+		{l: 100, other: 100, want: 0},
+		{l: 40, other: 100, want: 0},
+		{l: 1 << 32, other: 1<<32 - 1, want: 1},
+	}
+
+	for _, tt := range tests {
+		if got := tt.l.Diff(tt.other); got != tt.want {
+			t.Errorf("%v.Diff(%v) = %v, want %v", tt.l, tt.other, got, tt.want)
+		}
+	}
+}
+
+func TestLSNText(t *testing.T) {
+	lsn := LSN(0x16<<32 | 0xB374D848)
+	text, err := lsn.MarshalText()
+	if err != nil {
+		t.Fatalf("MarshalText: %v", err)
+	}
+
+	var got LSN
+	if err := got.UnmarshalText(text); err != nil {
+		t.Fatalf("UnmarshalText: %v", err)
+	}
+	if got != lsn {
+		t.Fatalf("round trip of %v gave %v", lsn, got)
+	}
+
+	if err := got.UnmarshalText([]byte("invalid")); err == nil {
+		t.Fatalf("expected an error unmarshalling an invalid lsn")
+	}
+}
@@ -2,6 +2,7 @@ package postgresql
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/avast/retry-go"
 	"github.com/jackc/pgx/v5"
@@ -14,19 +15,28 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Postmaster struct {
 	Config
 	Log *logrus.Entry
 
+	// local is shared by every copy of the postmaster
+	local *localConn
+	pid   int
+}
+
+// localConn is the connection to the local postgres with the lock serializing its use
+type localConn struct {
+	mu   sync.Mutex
 	conn *pgx.Conn
-	pid  int
 }
 
 func NewPostmaster(config Config, log *logrus.Entry) Postmaster {
 	logWithField := log.WithField("subcomponent", "postgres")
-	return Postmaster{Config: config, Log: logWithField}
+	return Postmaster{Config: config, Log: logWithField, local: &localConn{}}
 }
 
 func (p *Postmaster) Init() error {
@@ -101,6 +111,70 @@ func (p *Postmaster) IsRunning() bool {
 	return p.isRunning()
 }
 
+// GetState maps the pg_isready exit status to the postgres state: rejecting connections means starting up or shutting
+// down, no response means stopped
+func (p *Postmaster) GetState() string {
+	cmd := exec.Command("pg_isready")
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("PGPASSWORD=%v", p.AdminPassword))
+	err := cmd.Run()
+	if err == nil {
+		return PostgresStateRunning
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return PostgresStateStarting
+	}
+
+	return PostgresStateStopped
+}
+
+// Reload makes postgres read its configuration files again, parameters requiring a restart are reported by
+// GetPendingRestart
+func (p *Postmaster) Reload() error {
+	cmd := exec.Command(
+		"pg_ctl",
+		"reload",
+		"-D",
+		fmt.Sprintf(`%v`, p.DataDir),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_ctl error: %v", err)
+	}
+
+	return nil
+}
+
+// GetPendingRestart returns the parameters changed in the configuration files which need a restart to be applied
+func (p *Postmaster) GetPendingRestart(ctx context.Context) ([]string, error) {
+	conn, release, err := p.AcquireConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := conn.Query(ctx, "select name from pg_settings where pending_restart order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
 func (p *Postmaster) Promote() error {
 	cmd := exec.Command(
 		"pg_ctl",
@@ -116,28 +190,241 @@ func (p *Postmaster) Promote() error {
 	return cmd.Process.Release()
 }
 
-func (p *Postmaster) SyncData(leaderHostname string) error {
+// Rewind synchronizes the data directory with the leader one, discarding the WAL written after the timelines
+// diverged. Since PG13 pg_rewind runs the crash recovery by itself if the data directory was not cleanly shut down
+func (p *Postmaster) Rewind(leaderHostname string) error {
+	p.Log.Infof("rewinding data directory from leader at host %v", leaderHostname)
 	cmd := exec.Command(
 		"pg_rewind",
-		fmt.Sprintf(`--source-server="host=%v port=%v dbname="`),
-		fmt.Sprintf(`--target-pgdata=%v`, p.DataDir),
+		fmt.Sprintf(
+			"--source-server=host=%v port=5432 user=%v dbname=postgres",
+			leaderHostname,
+			p.AdminUsername,
+		),
+		fmt.Sprintf("--target-pgdata=%v", p.DataDir),
+		"--progress",
 	)
-
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("PGPASSWORD=%v", p.AdminPassword))
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_rewind error: %v", err)
+	}
+
+	// pg_rewind copies postgresql.auto.conf from the leader, which may still contain the recovery settings written
+	// by pg_basebackup when the leader itself was a replica
+	return p.removeAutoConfRecoverySettings()
+}
+
+// CreateStandbySignal makes postgres start in recovery mode
+func (p *Postmaster) CreateStandbySignal() error {
+	return ioutil.WriteFile(path.Join(p.DataDir, standbySignalFile), []byte{}, 0600)
+}
+
+// HasStandbySignal tells if postgres, once started, will be in recovery mode
+func (p *Postmaster) HasStandbySignal() (bool, error) {
+	_, err := os.Stat(path.Join(p.DataDir, standbySignalFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ControlData returns the output of pg_controldata for the local data directory
+func (p *Postmaster) ControlData() (ControlData, error) {
+	cmd := exec.Command("pg_controldata", "-D", p.DataDir)
+	// The labels are translated, force them in english
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, "LC_ALL=C")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("pg_controldata error: %v", err)
+	}
+
+	return parseControlData(string(out)), nil
+}
+
+// GetTimeline returns the timeline postgres is currently on. For a leader the timeline is taken from the current WAL
+// file name, as pg_control_checkpoint() is not updated until the next checkpoint, for a replica it is the timeline the
+// wal receiver is streaming
+func (p *Postmaster) GetTimeline(ctx context.Context, conn *pgx.Conn) (int, error) {
+	var walFileName string
+	var replicaTimeline *int32
+	if err := conn.QueryRow(ctx, `select
+		case when pg_is_in_recovery() then '' else pg_walfile_name(pg_current_wal_lsn()) end,
+		case when pg_is_in_recovery()
+			then coalesce((select received_tli from pg_stat_wal_receiver), (select timeline_id from pg_control_checkpoint()))
+		end`,
+	).Scan(&walFileName, &replicaTimeline); err != nil {
+		return 0, err
+	}
+
+	if replicaTimeline != nil {
+		return int(*replicaTimeline), nil
+	}
+
+	if len(walFileName) < 8 {
+		return 0, fmt.Errorf("could not establish the timeline of a replica without wal receiver and checkpoint")
+	}
+
+	timeline, err := strconv.ParseInt(walFileName[:8], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse timeline from wal file name %v: %v", walFileName, err)
+	}
+
+	return int(timeline), nil
+}
+
+// GetLocalTimeline returns the timeline of the local postgres, see GetTimeline
+func (p *Postmaster) GetLocalTimeline(ctx context.Context) (int, error) {
+	conn, release, err := p.AcquireConn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	return p.GetTimeline(ctx, conn)
+}
+
+// GetVersion returns the postgres server version, for example 15.2
+func (p *Postmaster) GetVersion(ctx context.Context) (string, error) {
+	conn, release, err := p.AcquireConn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	var version string
+	if err := conn.QueryRow(ctx, "show server_version").Scan(&version); err != nil {
+		return "", err
+	}
+
+	return version, nil
+}
+
+// GetReplayDelay returns how long ago the last replayed transaction was committed on the leader. It keeps growing
+// while the leader has no writes
+func (p *Postmaster) GetReplayDelay(ctx context.Context) (time.Duration, error) {
+	conn, release, err := p.AcquireConn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	var seconds float64
+	if err := conn.QueryRow(
+		ctx,
+		"select coalesce(extract(epoch from now() - pg_last_xact_replay_timestamp()), 0)::float8",
+	).Scan(&seconds); err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// GetWALPositions returns the WAL position received and replayed by postgres, for a leader both are its current WAL
+// position
+func (p *Postmaster) GetWALPositions(ctx context.Context) (LSN, LSN, error) {
+	conn, release, err := p.AcquireConn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+
+	var received, replayed string
+	if err := conn.QueryRow(ctx, `select
+		case when pg_is_in_recovery()
+			then coalesce(pg_last_wal_receive_lsn(), pg_last_wal_replay_lsn(), '0/0')
+			else pg_current_wal_lsn() end::text,
+		case when pg_is_in_recovery()
+			then coalesce(pg_last_wal_replay_lsn(), '0/0')
+			else pg_current_wal_lsn() end::text`,
+	).Scan(&received, &replayed); err != nil {
+		return 0, 0, err
+	}
+
+	receivedLSN, err := ParseLSN(received)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	replayedLSN, err := ParseLSN(replayed)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The wal receiver may not have started yet, while the startup process already replayed the local WAL
+	if replayedLSN > receivedLSN {
+		receivedLSN = replayedLSN
+	}
+
+	return receivedLSN, replayedLSN, nil
+}
+
+// GetReceivedLSN returns the WAL position received by the replica behind the given connection, zero if its wal receiver
+// never received anything
+func (p *Postmaster) GetReceivedLSN(ctx context.Context, conn *pgx.Conn) (LSN, error) {
+	var received string
+	if err := conn.QueryRow(ctx, "select coalesce(pg_last_wal_receive_lsn(), '0/0')::text").Scan(&received); err != nil {
+		return 0, err
+	}
+
+	return ParseLSN(received)
+}
+
+// WaitForPromotion waits until postgres behind the given connection is out of recovery, a leader which won the
+// election may still be promoting, and returns its current WAL position
+func (p *Postmaster) WaitForPromotion(ctx context.Context, conn *pgx.Conn) (LSN, error) {
+	var current string
+	err := retry.Do(
+		func() error {
+			var isInRecovery bool
+			if err := conn.QueryRow(
+				ctx,
+				"select pg_is_in_recovery(), case when pg_is_in_recovery() then '0/0' else pg_current_wal_lsn() end::text",
+			).Scan(&isInRecovery, &current); err != nil {
+				return retry.Unrecoverable(err)
+			}
+
+			if isInRecovery {
+				return fmt.Errorf("postgres is still in recovery")
+			}
+
+			return nil
+		},
+		retry.Context(ctx),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return ParseLSN(current)
+}
+
+// Checkpoint forces an immediate checkpoint
+func (p *Postmaster) Checkpoint(ctx context.Context) error {
+	conn, release, err := p.AcquireConn(ctx)
+	if err != nil {
 		return err
 	}
+	defer release()
 
-	return nil
+	_, err = conn.Exec(ctx, "checkpoint")
+	return err
 }
 
 func (p *Postmaster) IsInRecovery(ctx context.Context) (bool, error) {
-	conn, err := p.Connect(ctx)
+	conn, release, err := p.AcquireConn(ctx)
 	if err != nil {
 		p.Log.Errorf("could not connect to establish if postgres is in recovery")
 		return false, err
 	}
+	defer release()
 	var isInRecovery bool
 	if err := conn.QueryRow(ctx, "select pg_is_in_recovery()").Scan(&isInRecovery); err != nil {
 		p.Log.Errorf("could not execute query to establish if Postgres is in recovery, skipping: %v", err)
@@ -162,38 +449,38 @@ func (p *Postmaster) IsDataDirEmpty() (bool, error) {
 	return false, err // Either not empty or error, suits both cases
 }
 
-func (p *Postmaster) Connect(ctx context.Context) (*pgx.Conn, error) {
-	return p.ConnectWithRetry(ctx, retry.DefaultAttempts)
-}
-
-func (p *Postmaster) ConnectTo(ctx context.Context, hostname string) (*pgx.Conn, error) {
-	return p.connectWithRetry(ctx, hostname, retry.DefaultAttempts)
-}
-
-func (p *Postmaster) ConnectWithRetry(ctx context.Context, retries uint) (*pgx.Conn, error) {
-	if p.conn != nil {
+// AcquireConn returns the connection to the local postgres, which is shared by the daemon and the api goroutines: a
+// pgx.Conn is not safe for concurrent use, so the caller holds it exclusively until it calls release
+func (p *Postmaster) AcquireConn(ctx context.Context) (*pgx.Conn, func(), error) {
+	p.local.mu.Lock()
+	if p.local.conn != nil {
 		// Check if the connection is still active and if not reconnect again
-		if err := p.conn.Ping(ctx); err != nil {
-			conn, err := p.connectWithRetry(ctx, "localhost", retries)
-			if err != nil {
-				return nil, err
-			}
-
-			p.conn = conn
-			return p.conn, nil
+		if err := p.local.conn.Ping(ctx); err == nil {
+			p.Log.Debugf("Reusing connection with PID: %v", p.local.conn.PgConn().PID())
+			return p.local.conn, p.local.mu.Unlock, nil
 		}
 
-		p.Log.Debugf("Reusing connection with PID: %v", p.conn.PgConn().PID())
-		return p.conn, nil
+		p.local.conn.Close(ctx)
+		p.local.conn = nil
 	}
 
-	conn, err := p.connectWithRetry(ctx, "localhost", retries)
+	conn, err := p.connectWithRetry(ctx, "localhost", retry.DefaultAttempts)
 	if err != nil {
-		return nil, err
+		p.local.mu.Unlock()
+		return nil, nil, err
 	}
 
-	p.conn = conn
-	return p.conn, nil
+	p.local.conn = conn
+	return p.local.conn, p.local.mu.Unlock, nil
+}
+
+func (p *Postmaster) ConnectTo(ctx context.Context, hostname string) (*pgx.Conn, error) {
+	return p.connectWithRetry(ctx, hostname, retry.DefaultAttempts)
+}
+
+// ProbeConnectTo tries to connect only once, for hosts that are likely down
+func (p *Postmaster) ProbeConnectTo(ctx context.Context, hostname string) (*pgx.Conn, error) {
+	return p.connectWithRetry(ctx, hostname, 1)
 }
 
 func (p *Postmaster) BlockAndWaitForLeader(leaderHostname string) error {
@@ -239,7 +526,9 @@ func (p *Postmaster) MakeBaseBackup(leaderHostname string) error {
 		return err
 	}
 
-	return nil
+	// pg_basebackup -R writes its own primary_conninfo, without the application name, which would take precedence
+	// over the one written in postgresql.conf
+	return p.removeAutoConfRecoverySettings()
 }
 
 func (p *Postmaster) EmptyDataDir() error {
@@ -364,6 +653,29 @@ func (p *Postmaster) isRunning() bool {
 	return true
 }
 
+func (p *Postmaster) removeAutoConfRecoverySettings() error {
+	autoConfPath := path.Join(p.DataDir, "postgresql.auto.conf")
+	autoConf, err := ioutil.ReadFile(autoConfPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lines := make([]string, 0)
+	for _, line := range strings.Split(string(autoConf), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "primary_conninfo") || strings.HasPrefix(trimmed, "primary_slot_name") {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	return ioutil.WriteFile(autoConfPath, []byte(strings.Join(lines, "\n")), 0600)
+}
+
 func (p *Postmaster) createPasswordFile(filename string) error {
 	return ioutil.WriteFile(filename, []byte(p.AdminPassword), 0700)
 }
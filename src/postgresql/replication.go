@@ -0,0 +1,167 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	SyncStateSync   = "sync"
+	SyncStateQuorum = "quorum"
+)
+
+// ReplicationStat is a row of pg_stat_replication, ApplicationName is the replica hostname
+type ReplicationStat struct {
+	ApplicationName string
+	State           string
+	SyncState       string
+	FlushLSN        LSN
+}
+
+// IsSynchronous tells if the leader is currently waiting for the replica to acknowledge commits
+func (r ReplicationStat) IsSynchronous() bool {
+	return r.SyncState == SyncStateSync || r.SyncState == SyncStateQuorum
+}
+
+// GetReplicationStats returns the replicas streaming from the local postgres, the most advanced first
+func (p *Postmaster) GetReplicationStats(ctx context.Context) ([]ReplicationStat, error) {
+	conn, release, err := p.AcquireConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := conn.Query(ctx, `select application_name, state, sync_state, coalesce(flush_lsn, '0/0')::text
+		from pg_stat_replication
+		where state = 'streaming'
+		order by flush_lsn desc nulls last`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make([]ReplicationStat, 0)
+	for rows.Next() {
+		var stat ReplicationStat
+		var flushLSN string
+		if err := rows.Scan(&stat.ApplicationName, &stat.State, &stat.SyncState, &flushLSN); err != nil {
+			return nil, err
+		}
+
+		if stat.FlushLSN, err = ParseLSN(flushLSN); err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, rows.Err()
+}
+
+func (p *Postmaster) GetSynchronousStandbyNames(ctx context.Context) (string, error) {
+	conn, release, err := p.AcquireConn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	var names string
+	if err := conn.QueryRow(ctx, "show synchronous_standby_names").Scan(&names); err != nil {
+		return "", err
+	}
+
+	return names, nil
+}
+
+// SetSynchronousStandbyNames writes the setting in postgresql.auto.conf and reloads the configuration, no restart is
+// needed
+func (p *Postmaster) SetSynchronousStandbyNames(ctx context.Context, names string) error {
+	conn, release, err := p.AcquireConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// ALTER SYSTEM does not accept parameters
+	if _, err := conn.Exec(ctx, fmt.Sprintf(
+		"alter system set synchronous_standby_names = '%v'",
+		strings.ReplaceAll(names, "'", "''"),
+	)); err != nil {
+		return err
+	}
+
+	if _, err := conn.Exec(ctx, "select pg_reload_conf()"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// BuildSynchronousStandbyNames returns the synchronous_standby_names value: with quorum commits wait for any count of
+// the standbys, otherwise for the first count of them in order of priority. No standbys means asynchronous replication
+func BuildSynchronousStandbyNames(quorum bool, count int, standbys []string) string {
+	if len(standbys) == 0 {
+		return ""
+	}
+
+	if count > len(standbys) {
+		count = len(standbys)
+	}
+
+	quoted := make([]string, 0, len(standbys))
+	for _, standby := range standbys {
+		quoted = append(quoted, fmt.Sprintf(`"%v"`, strings.ReplaceAll(standby, `"`, `""`)))
+	}
+
+	method := "FIRST"
+	if quorum {
+		method = "ANY"
+	}
+
+	return fmt.Sprintf("%v %v (%v)", method, count, strings.Join(quoted, ","))
+}
+
+// PhysicalSlot is a row of pg_replication_slots, it is named after the hostname of the replica using it
+type PhysicalSlot struct {
+	Name   string
+	Active bool
+}
+
+// GetReplicationSlots returns the physical slots of the local postgres
+func (p *Postmaster) GetReplicationSlots(ctx context.Context) ([]PhysicalSlot, error) {
+	conn, release, err := p.AcquireConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := conn.Query(ctx, "select slot_name, active from pg_replication_slots where slot_type = 'physical'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	slots := make([]PhysicalSlot, 0)
+	for rows.Next() {
+		var slot PhysicalSlot
+		if err := rows.Scan(&slot.Name, &slot.Active); err != nil {
+			return nil, err
+		}
+
+		slots = append(slots, slot)
+	}
+
+	return slots, rows.Err()
+}
+
+func (p *Postmaster) DropReplicationSlot(ctx context.Context, name string) error {
+	conn, release, err := p.AcquireConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, err = conn.Exec(ctx, "select pg_drop_replication_slot($1)", name)
+	return err
+}